@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"log"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -63,7 +64,7 @@ var mountFlags = map[string]func(*pflag.FlagSet){
 		flags.Bool("foreground", false, "Stay in the foreground after mounting.")
 	},
 	"o": func(flags *pflag.FlagSet) {
-		flags.StringSliceP("o", "o", []string{}, "Additional system-specific mount options. Be careful!")
+		flags.StringArrayP("o", "o", []string{}, "Additional system-specific mount options. Be careful!")
 	},
 	"dir-mode": func(flags *pflag.FlagSet) {
 		flags.String("dir-mode", "755", "Permissions bits for directories, in octal.")
@@ -72,10 +73,43 @@ var mountFlags = map[string]func(*pflag.FlagSet){
 		flags.String("file-mode", "644", "Permission bits for files, in octal.")
 	},
 	"uid": func(flags *pflag.FlagSet) {
-		flags.Int("uid", -1, "UID owner of all inodes.")
+		flags.Int("uid", -1, "UID owner of all new inodes. Defaults to the creating process.")
 	},
 	"gid": func(flags *pflag.FlagSet) {
-		flags.Int("gid", -1, "GID owner of all inodes.")
+		flags.Int("gid", -1, "GID owner of all new inodes. Defaults to the creating process.")
+	},
+	"size": func(flags *pflag.FlagSet) {
+		flags.String("size", "0", "Maximum size of file contents, e.g. 512m, 2g or 50% of memory. Zero means no limit.")
+	},
+	"nr-inodes": func(flags *pflag.FlagSet) {
+		flags.Uint64("nr-inodes", 0, "Maximum number of inodes. Zero means no limit.")
+	},
+	"attr-timeout": func(flags *pflag.FlagSet) {
+		flags.Duration("attr-timeout", time.Minute, "How long the kernel may cache inode attributes.")
+	},
+	"entry-timeout": func(flags *pflag.FlagSet) {
+		flags.Duration("entry-timeout", time.Minute, "How long the kernel may cache directory entries.")
+	},
+	"negative-timeout": func(flags *pflag.FlagSet) {
+		flags.Duration("negative-timeout", time.Minute, "How long the kernel may cache failed lookups. Zero disables caching them.")
+	},
+	"read-only": func(flags *pflag.FlagSet) {
+		flags.Bool("read-only", false, "Reject every change with EROFS. SIGUSR1 and SIGUSR2 switch to read-only and read-write while mounted.")
+	},
+	"writeback-cache": func(flags *pflag.FlagSet) {
+		flags.Bool("writeback-cache", false, "Let the kernel buffer writes and send them in batches.")
+	},
+	"load": func(flags *pflag.FlagSet) {
+		flags.String("load", "", "Snapshot file to populate the file system from, if it exists.")
+	},
+	"seed": func(flags *pflag.FlagSet) {
+		flags.String("seed", "", "Directory to copy into the file system before serving it.")
+	},
+	"save-on-unmount": func(flags *pflag.FlagSet) {
+		flags.String("save-on-unmount", "", "Snapshot file to save the file system to after it is unmounted.")
+	},
+	"journal": func(flags *pflag.FlagSet) {
+		flags.String("journal", "", "Journal file to log changes to, so that synced data survives a crash.")
 	},
 	"debug_fuse": func(flags *pflag.FlagSet) {
 		flags.Bool("debug_fuse", false, "Enable fuse-related debugging output.")
@@ -6,6 +6,7 @@ import (
 	"net"
 	"net/http"
 	_ "net/http/pprof" // Comment this line to disable pprof endpoint.
+	"os"
 	"strings"
 	"sync"
 
@@ -42,6 +43,12 @@ func Main() {
 		globalTermWidth = w
 	}
 
+	// When installed as mount.memfs, mount(8) runs us as the helper for
+	// file systems of type memfs.
+	if isMountHelper(os.Args[0]) {
+		rootCmd.SetArgs(append([]string{mountHelperCmd.Name()}, os.Args[1:]...))
+	}
+
 	if err := rootCmd.Execute(); err != nil {
 		once.Do(mainExitFn)
 		exit()
@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+
+	mountpkg "github.com/zbiljic/memfs/pkg/mount"
+)
+
+var mountHelperCmd = &cobra.Command{
+	Use:   "mount-helper <source> <dir> [-sfnv] [-o options]",
+	Short: "Mount a In-Memory file system on behalf of mount(8)",
+	Long: `Mount a In-Memory file system on behalf of mount(8).
+
+This is what runs when the binary is invoked as mount.memfs, which lets
+mount(8) mount file systems of type memfs, such as the /etc/fstab entry
+
+    memfs /scratch memfs size=4g,uid=1000,_netdev 0 0
+
+The source is ignored. Options that only matter to mount(8) and systemd, such
+as noauto, user, nofail and x-systemd.*, are dropped, and the rest are passed
+on to the mount command as -o options.`,
+	DisableFlagParsing: true,
+	Run: func(cmd *cobra.Command, args []string) {
+		mountHelperMain(args)
+	},
+}
+
+func init() {
+	// add 'mount-helper' command to root command
+	rootCmd.AddCommand(mountHelperCmd)
+}
+
+// The names under which mount(8) looks for our helper, for file systems of
+// type memfs and fuse.memfs respectively.
+var mountHelperNames = []string{
+	"mount." + AppName,
+	"mount.fuse." + AppName,
+}
+
+// Is the binary being invoked as a mount helper, rather than by its own name?
+// The daemon is always started with the arguments of the mount command.
+func isMountHelper(argv0 string) bool {
+	if globalIsDaemon {
+		return false
+	}
+
+	name := filepath.Base(argv0)
+	for _, n := range mountHelperNames {
+		if name == n {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The arguments mount(8) passes to a mount helper.
+type mountHelperArgs struct {
+	MountPoint string
+
+	// The values given with -o, still escaped.
+	Options []string
+
+	// With -s, unknown options are ignored rather than rejected.
+	Sloppy bool
+
+	// With -f, everything is checked but nothing is mounted.
+	Fake bool
+}
+
+// Parse the arguments of a mount helper, which mount(8) gives as
+//
+//	<source> <dir> [-sfnv] [-N namespace] [-o options] [-t type]
+//
+// though the flags may come anywhere.
+func parseMountHelperArgs(args []string) (h mountHelperArgs, err error) {
+	var positional []string
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			positional = append(positional, arg)
+			continue
+		}
+
+		// Short flags may be combined, and the last one may take a value,
+		// either attached or as the next argument.
+		for j := 1; j < len(arg); j++ {
+			switch flag := arg[j]; flag {
+			case 's':
+				h.Sloppy = true
+
+			case 'f':
+				h.Fake = true
+
+			case 'n', 'v':
+				// We keep no mtab, and have nothing more to say.
+
+			case 'o', 't', 'N':
+				value := arg[j+1:]
+				if value == "" {
+					i++
+					if i == len(args) {
+						err = fmt.Errorf("Flag -%c requires a value", flag)
+						return
+					}
+
+					value = args[i]
+				}
+
+				switch flag {
+				case 'o':
+					h.Options = append(h.Options, value)
+
+				case 'N':
+					err = fmt.Errorf("Mount namespaces are not supported")
+					return
+				}
+
+				j = len(arg)
+
+			default:
+				err = fmt.Errorf("Unknown flag: -%c", flag)
+				return
+			}
+		}
+	}
+
+	if len(positional) != 2 {
+		err = fmt.Errorf("Expected a source and a mount point, got %d arguments",
+			len(positional))
+		return
+	}
+
+	h.MountPoint = positional[1]
+	return
+}
+
+// Is the given option one that only matters to mount(8), systemd, or whoever
+// else reads /etc/fstab, rather than to the file system?
+func isFstabOption(name string) bool {
+	switch name {
+	case "defaults", "auto", "noauto", "user", "nouser", "users", "owner",
+		"group", "nofail", "_netdev", "comment":
+		return true
+	}
+
+	return strings.HasPrefix(name, "x-")
+}
+
+// Return the arguments of the mount command that do what the helper was asked
+// to do.
+func (h *mountHelperArgs) mountCommandArgs() (args []string) {
+	options := make(map[string]string)
+	for _, o := range h.Options {
+		mountpkg.ParseOptions(options, o)
+	}
+
+	for name := range options {
+		_, known := mountOptions[name]
+		switch {
+		case isFstabOption(name):
+			delete(options, name)
+
+		case !known && h.Sloppy:
+			log.Printf("INFO Ignoring unknown mount option: %s", name)
+			delete(options, name)
+		}
+	}
+
+	args = []string{mountCmd.Name()}
+	if len(options) != 0 {
+		args = append(args, "-o", mountpkg.FormatOptions(options))
+	}
+
+	args = append(args, h.MountPoint)
+	return
+}
+
+func mountHelperMain(args []string) {
+	h, err := parseMountHelperArgs(args)
+	fatalIf(errors.WithStack(err), "Invalid mount helper call.")
+
+	// From here on, behave exactly as the mount command would. That includes
+	// starting the daemon with the arguments of the mount command.
+	mountArgs := h.mountCommandArgs()
+	os.Args = append(os.Args[:1:1], mountArgs...)
+
+	err = mountCmd.ParseFlags(mountArgs[1:])
+	fatalIf(errors.WithStack(err), "Invalid mount helper call.")
+
+	err = checkMountSyntax(mountCmd, mountCmd.Flags().Args())
+	fatalIf(errors.WithStack(err), "Invalid mount helper call.")
+
+	if h.Fake {
+		return
+	}
+
+	mountMain()
+}
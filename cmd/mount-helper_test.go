@@ -0,0 +1,62 @@
+package cmd
+
+import . "gopkg.in/check.v1"
+
+func (s *TestSuite) TestParseMountHelperArgs(c *C) {
+	h, err := parseMountHelperArgs([]string{
+		"memfs", "/scratch", "-sn", "-o", "size=4g", "-ouid=1000", "-t", "memfs",
+	})
+
+	c.Assert(err, IsNil)
+	c.Check(h, DeepEquals, mountHelperArgs{
+		MountPoint: "/scratch",
+		Options:    []string{"size=4g", "uid=1000"},
+		Sloppy:     true,
+	})
+}
+
+func (s *TestSuite) TestParseMountHelperArgsErrors(c *C) {
+	for _, args := range [][]string{
+		{"memfs"},
+		{"memfs", "/scratch", "extra"},
+		{"memfs", "/scratch", "-o"},
+		{"memfs", "/scratch", "-x"},
+		{"memfs", "/scratch", "-N", "/proc/1/ns/mnt"},
+	} {
+		_, err := parseMountHelperArgs(args)
+		c.Check(err, NotNil, Commentf("%q", args))
+	}
+}
+
+func (s *TestSuite) TestMountHelperDropsFstabOptions(c *C) {
+	h := mountHelperArgs{
+		MountPoint: "/scratch",
+		Options: []string{
+			"size=4g,uid=1000,_netdev,noauto,user=alice,nofail,x-systemd.automount",
+		},
+	}
+
+	c.Assert(h.mountCommandArgs(), DeepEquals, []string{
+		"mount", "-o", "size=4g,uid=1000", "/scratch",
+	})
+}
+
+func (s *TestSuite) TestMountHelperSloppy(c *C) {
+	h := mountHelperArgs{
+		MountPoint: "/scratch",
+		Options:    []string{"taco,defaults"},
+	}
+
+	c.Assert(h.mountCommandArgs(), DeepEquals, []string{
+		"mount", "-o", "taco", "/scratch",
+	})
+
+	h.Sloppy = true
+	c.Assert(h.mountCommandArgs(), DeepEquals, []string{"mount", "/scratch"})
+}
+
+func (s *TestSuite) TestIsMountHelper(c *C) {
+	c.Check(isMountHelper("/sbin/mount.memfs"), Equals, true)
+	c.Check(isMountHelper("mount.fuse.memfs"), Equals, true)
+	c.Check(isMountHelper("/usr/bin/memfs"), Equals, false)
+}
@@ -6,13 +6,16 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
 	"golang.org/x/sys/unix"
 
+	"github.com/cheggaaa/pb"
 	"github.com/jacobsa/daemonize"
 	"github.com/jacobsa/fuse"
 	"github.com/jacobsa/syncutil"
@@ -47,6 +50,17 @@ var mountFlagsBind = []string{
 	"file-mode",
 	"uid",
 	"gid",
+	"size",
+	"nr-inodes",
+	"attr-timeout",
+	"entry-timeout",
+	"negative-timeout",
+	"read-only",
+	"writeback-cache",
+	"load",
+	"seed",
+	"save-on-unmount",
+	"journal",
 	"debug_fuse",
 	"debug_invariants",
 }
@@ -65,11 +79,29 @@ type mountArgs struct {
 	Foreground bool
 
 	// File system
-	MountOptions map[string]string
-	DirMode      os.FileMode
-	FileMode     os.FileMode
-	Uid          int
-	Gid          int
+	MountOptions  map[string]string
+	KernelOptions map[string]string
+	DirMode       os.FileMode
+	FileMode      os.FileMode
+	Uid           int
+	Gid           int
+	RootUid       int
+	RootGid       int
+	Size          uint64
+	NrInodes      uint64
+	ReadOnly      bool
+
+	// Kernel caching
+	AttrTimeout     time.Duration
+	EntryTimeout    time.Duration
+	NegativeTimeout time.Duration
+	WritebackCache  bool
+
+	// Persistence
+	LoadFile          string
+	SeedDir           string
+	SaveOnUnmountFile string
+	JournalFile       string
 
 	// Debugging
 	DebugFuse       bool
@@ -78,9 +110,11 @@ type mountArgs struct {
 
 var mountArgsHolder = &mountArgs{
 	MountOptions: make(map[string]string),
+	RootUid:      -1,
+	RootGid:      -1,
 }
 
-func populateArgsHolderMount(args []string) {
+func populateArgsHolderMount(cmd *cobra.Command, args []string) {
 	// from command arguments
 	mountArgsHolder.MountPoint = valueOrEmptyString(args, 0)
 
@@ -89,8 +123,9 @@ func populateArgsHolderMount(args []string) {
 
 	mountArgsHolder.Foreground = viper.GetBool(argsSection("foreground"))
 
-	optionsArray := viper.GetStringSlice(argsSection("o"))
-	// Handle the repeated "-o" flag.
+	// Handle the repeated "-o" flag. Read it straight from the flag, since
+	// viper would split its values on every comma, escaped or not.
+	optionsArray, _ := cmd.Flags().GetStringArray("o")
 	for _, o := range optionsArray {
 		mountpkg.ParseOptions(mountArgsHolder.MountOptions, o)
 	}
@@ -109,6 +144,29 @@ func populateArgsHolderMount(args []string) {
 	gid := viper.GetInt(argsSection("gid"))
 	mountArgsHolder.Gid = gid
 
+	size, err := parseTmpfsSize(viper.GetString(argsSection("size")), true)
+	fatalIf(errors.WithStack(err), "Provided value for --size is not valid")
+	mountArgsHolder.Size = size
+
+	mountArgsHolder.NrInodes = viper.GetUint64(argsSection("nr-inodes"))
+
+	mountArgsHolder.ReadOnly = viper.GetBool(argsSection("read-only")) ||
+		hasOption(mountArgsHolder.MountOptions, "ro")
+
+	// The tmpfs options given with -o override the flags above.
+	err = applyTmpfsOptions(mountArgsHolder)
+	fatalIf(errors.WithStack(err), "Provided value for -o is not valid.")
+
+	mountArgsHolder.AttrTimeout = viper.GetDuration(argsSection("attr-timeout"))
+	mountArgsHolder.EntryTimeout = viper.GetDuration(argsSection("entry-timeout"))
+	mountArgsHolder.NegativeTimeout = viper.GetDuration(argsSection("negative-timeout"))
+	mountArgsHolder.WritebackCache = viper.GetBool(argsSection("writeback-cache"))
+
+	mountArgsHolder.LoadFile = viper.GetString(argsSection("load"))
+	mountArgsHolder.SeedDir = viper.GetString(argsSection("seed"))
+	mountArgsHolder.SaveOnUnmountFile = viper.GetString(argsSection("save-on-unmount"))
+	mountArgsHolder.JournalFile = viper.GetString(argsSection("journal"))
+
 	mountArgsHolder.DebugFuse = viper.GetBool(argsSection("debug_fuse"))
 	mountArgsHolder.DebugInvariants = viper.GetBool(argsSection("debug_invariants"))
 
@@ -116,7 +174,7 @@ func populateArgsHolderMount(args []string) {
 
 func checkMountSyntax(cmd *cobra.Command, args []string) error {
 
-	populateArgsHolderMount(args)
+	populateArgsHolderMount(cmd, args)
 
 	if mountArgsHolder.MountPoint == "" {
 		fatalIf(errDummy(),
@@ -153,6 +211,59 @@ func checkMountSyntax(cmd *cobra.Command, args []string) error {
 
 	}
 
+	if mountArgsHolder.LoadFile != "" {
+		fi, err := os.Stat(mountArgsHolder.LoadFile)
+		if err == nil && fi.IsDir() {
+			fatalIf(errDummy(),
+				"Provided value for --load is a directory")
+		}
+	}
+
+	if mountArgsHolder.LoadFile != "" && mountArgsHolder.JournalFile != "" {
+		fatalIf(errDummy(),
+			"Flags --load and --journal cannot be used together")
+	}
+
+	if mountArgsHolder.SeedDir != "" {
+		fi, err := os.Stat(mountArgsHolder.SeedDir)
+		if err != nil {
+			fatalIf(errors.WithStack(err),
+				"Provided value for --seed not found")
+		}
+
+		if !fi.IsDir() {
+			fatalIf(errDummy(),
+				"Provided value for --seed is not a directory")
+		}
+	}
+
+	// Seeding copies into an empty file system, not one restored from disk.
+	if mountArgsHolder.SeedDir != "" &&
+		(mountArgsHolder.LoadFile != "" || mountArgsHolder.JournalFile != "") {
+		fatalIf(errDummy(),
+			"Flag --seed cannot be used with --load or --journal")
+	}
+
+	kernelOptions, err := kernelMountOptions(mountArgsHolder.MountOptions)
+	fatalIf(errors.WithStack(err), "Provided value for -o is not valid.")
+	mountArgsHolder.KernelOptions = kernelOptions
+
+	if mountArgsHolder.AttrTimeout < 0 ||
+		mountArgsHolder.EntryTimeout < 0 ||
+		mountArgsHolder.NegativeTimeout < 0 {
+		fatalIf(errDummy(),
+			"Cache timeouts cannot be negative.")
+	}
+
+	if mountArgsHolder.Uid > -1 && mountArgsHolder.RootUid > -1 {
+		fatalIf(errDummy(),
+			"Flag --uid and mount option uid cannot be used together.")
+	}
+	if mountArgsHolder.Gid > -1 && mountArgsHolder.RootGid > -1 {
+		fatalIf(errDummy(),
+			"Flag --gid and mount option gid cannot be used together.")
+	}
+
 	if uint32(mountArgsHolder.Uid) > maxUint32 {
 		fatalIf(errDummy(),
 			"Provided value for --uid is not valid.")
@@ -203,6 +314,27 @@ func mountMain() {
 
 }
 
+// Is the given option present in the -o options?
+func hasOption(options map[string]string, name string) bool {
+	_, ok := options[name]
+	return ok
+}
+
+// Return how reads should update access times according to the noatime,
+// relatime and strictatime mount options. If more than one is given, noatime
+// wins over strictatime, which wins over the default relatime.
+func atimeModeFromOptions(options map[string]string) filesystem.AtimeMode {
+	if _, ok := options["noatime"]; ok {
+		return filesystem.AtimeNever
+	}
+
+	if _, ok := options["strictatime"]; ok {
+		return filesystem.AtimeStrict
+	}
+
+	return filesystem.AtimeRelative
+}
+
 func printWarningForRoot(uid uint32) {
 	if uid == 0 && !isInDocker() {
 		fmt.Fprintf(os.Stdout,
@@ -220,6 +352,34 @@ func isInDocker() bool {
 	return os.Getenv("DOCKERIMAGE") == "1"
 }
 
+// Copy the given directory into the file system, showing a progress bar when
+// running in a terminal.
+func seedFileSystem(server *filesystem.Server, dir string) (err error) {
+	log.Printf("INFO Seeding file system from '%s'.", dir)
+
+	var progress filesystem.SeedProgress
+	if !globalQuiet && !globalIsDaemon && globalTermWidth > 0 {
+		bar := pb.New64(0).SetUnits(pb.U_BYTES)
+		bar.SetWidth(globalTermWidth)
+		bar.Start()
+		defer bar.Finish()
+
+		progress = func(copied, total int64) {
+			bar.SetTotal64(total)
+			bar.Set64(copied)
+		}
+	}
+
+	start := time.Now()
+	err = server.Seed(dir, progress)
+	if err != nil {
+		return
+	}
+
+	log.Printf("INFO Seeded file system from '%s' in %v.", dir, time.Since(start))
+	return
+}
+
 func foregroundMount() error {
 	if !globalIsDaemon {
 		logger.SetupLogging(globalDebug, globalQuiet, "") // will use os.Stderr
@@ -239,14 +399,44 @@ func foregroundMount() error {
 	if mountArgsHolder.Gid > -1 {
 		gid = uint32(mountArgsHolder.Gid)
 	}
+	if mountArgsHolder.RootUid > -1 {
+		uid = uint32(mountArgsHolder.RootUid)
+	}
+	if mountArgsHolder.RootGid > -1 {
+		gid = uint32(mountArgsHolder.RootGid)
+	}
 	printWarningForRoot(uid)
 
+	// Restore the snapshot if there is one. A missing snapshot is not an error,
+	// so the same file can be used with --save-on-unmount across runs.
+	snapshotFile := mountArgsHolder.LoadFile
+	if snapshotFile != "" {
+		if _, err = os.Stat(snapshotFile); os.IsNotExist(err) {
+			log.Printf("INFO Snapshot '%s' does not exist, starting empty.", snapshotFile)
+			snapshotFile = ""
+		}
+	}
+
 	// Create a file system server.
 	serverCfg := &filesystem.ServerConfig{
-		Uid:       uid,
-		Gid:       gid,
-		FilePerms: mountArgsHolder.FileMode,
-		DirPerms:  mountArgsHolder.DirMode,
+		Uid:        uid,
+		Gid:        gid,
+		ForceUid:   mountArgsHolder.Uid > -1,
+		ForceGid:   mountArgsHolder.Gid > -1,
+		FilePerms:  mountArgsHolder.FileMode,
+		DirPerms:   mountArgsHolder.DirMode,
+		AtimeMode:  atimeModeFromOptions(mountArgsHolder.MountOptions),
+		ReadOnly:   mountArgsHolder.ReadOnly,
+		SizeLimit:  mountArgsHolder.Size,
+		InodeLimit: mountArgsHolder.NrInodes,
+
+		AttrTimeout:     mountArgsHolder.AttrTimeout,
+		EntryTimeout:    mountArgsHolder.EntryTimeout,
+		NegativeTimeout: mountArgsHolder.NegativeTimeout,
+		WritebackCache:  mountArgsHolder.WritebackCache,
+
+		SnapshotFile: snapshotFile,
+		JournalFile:  mountArgsHolder.JournalFile,
 	}
 
 	server, err := filesystem.NewServer(serverCfg)
@@ -256,6 +446,16 @@ func foregroundMount() error {
 		return err
 	}
 
+	// Copy in the seed directory, if any, before the kernel can see anything.
+	if mountArgsHolder.SeedDir != "" {
+		err = seedFileSystem(server, mountArgsHolder.SeedDir)
+		if err != nil {
+			err = errors.Errorf("Failed to seed file system: %v", err)
+			daemonize.SignalOutcome(err)
+			return err
+		}
+	}
+
 	// Mount the file system.
 	console.Println("Mounting file system...")
 
@@ -266,11 +466,19 @@ func foregroundMount() error {
 		options["daemon_timeout"] = "600" // 10 minutes for FS operation timeout.
 	}
 
+	// Pass on the options given with -o that are meant for the kernel, such as
+	// allow_other. Permissions are checked by the file system itself, so
+	// default_permissions is optional.
+	for name, value := range mountArgsHolder.KernelOptions {
+		options[name] = value
+	}
+
 	mountCfg := &fuse.MountConfig{
 		FSName:                  AppName,
 		VolumeName:              AppName,
 		Options:                 options,
-		DisableWritebackCaching: true,
+		DisableWritebackCaching: !mountArgsHolder.WritebackCache,
+		UseVectoredRead:         true,
 		ErrorLogger:             logger.NewLogger("fuse: "),
 	}
 
@@ -302,7 +510,27 @@ func foregroundMount() error {
 		}
 	}()
 
+	// Let a job fill the file system and then freeze it for the consumers that
+	// follow, or thaw it again, without unmounting.
+	readOnlyCh := make(chan os.Signal, 1)
+	signal.Notify(readOnlyCh, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(readOnlyCh)
+	go func() {
+		for sig := range readOnlyCh {
+			readOnly := sig == syscall.SIGUSR1
+			server.SetReadOnly(readOnly)
+
+			mode := "read-write"
+			if readOnly {
+				mode = "read-only"
+			}
+
+			log.Printf("INFO Received %s, file system is now %s.", sig.String(), mode)
+		}
+	}()
+
 	console.Println("File system mounted successfully.")
+	log.Printf("INFO Send SIGUSR1 or SIGUSR2 to process %d to make the file system read-only or read-write.", os.Getpid())
 
 	daemonize.SignalOutcome(nil)
 
@@ -314,6 +542,24 @@ func foregroundMount() error {
 		return err
 	}
 
+	// Write the final journal checkpoint, if any.
+	err = server.Close()
+	if err != nil {
+		err = errors.Errorf("Failed to close journal: %v", err)
+		return err
+	}
+
+	// Save the file system contents if requested.
+	if mountArgsHolder.SaveOnUnmountFile != "" {
+		log.Printf("INFO Saving snapshot to '%s'...", mountArgsHolder.SaveOnUnmountFile)
+
+		err = server.SaveSnapshot(mountArgsHolder.SaveOnUnmountFile)
+		if err != nil {
+			err = errors.Errorf("Failed to save snapshot: %v", err)
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -345,6 +591,10 @@ func daemonMount() error {
 
 	flagsWithPaths := []string{
 		"--log-file",
+		"--load",
+		"--seed",
+		"--save-on-unmount",
+		"--journal",
 	}
 
 	for i, arg := range args {
@@ -0,0 +1,294 @@
+package cmd
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/zbiljic/memfs/pkg/sysinfo"
+)
+
+// Who makes sense of a -o mount option.
+type mountOptionUse int
+
+const (
+	// Passed on to the kernel, by way of fusermount on Linux.
+	optionForKernel mountOptionUse = 1 << iota
+
+	// Interpreted by memfs itself.
+	optionForMemfs
+)
+
+// How a -o mount option is used, and whether it takes a value.
+type mountOption struct {
+	use        mountOptionUse
+	takesValue bool
+}
+
+// The -o mount options we accept. Anything else is rejected, rather than
+// silently ignored. Options the FUSE library sets itself, such as fd,
+// rootmode, user_id and group_id, are deliberately missing.
+var mountOptions = map[string]mountOption{
+	// Read-only mode is enforced by memfs rather than the kernel, so that it
+	// can be switched off again without remounting.
+	"ro": {use: optionForMemfs},
+	"rw": {use: optionForMemfs},
+
+	// Generic options, enforced by the kernel.
+	"suid":    {use: optionForKernel},
+	"nosuid":  {use: optionForKernel},
+	"dev":     {use: optionForKernel},
+	"nodev":   {use: optionForKernel},
+	"exec":    {use: optionForKernel},
+	"noexec":  {use: optionForKernel},
+	"sync":    {use: optionForKernel},
+	"async":   {use: optionForKernel},
+	"dirsync": {use: optionForKernel},
+
+	// FUSE options.
+	"allow_other":         {use: optionForKernel},
+	"allow_root":          {use: optionForKernel},
+	"default_permissions": {use: optionForKernel},
+	"auto_unmount":        {use: optionForKernel},
+	"max_read":            {use: optionForKernel, takesValue: true},
+	"blksize":             {use: optionForKernel, takesValue: true},
+
+	// Access time updates are up to the file system.
+	"noatime":     {use: optionForMemfs},
+	"relatime":    {use: optionForMemfs},
+	"strictatime": {use: optionForMemfs},
+
+	// The tmpfs options, so memfs can stand in for it.
+	"size":      {use: optionForMemfs, takesValue: true},
+	"nr_blocks": {use: optionForMemfs, takesValue: true},
+	"nr_inodes": {use: optionForMemfs, takesValue: true},
+	"mode":      {use: optionForMemfs, takesValue: true},
+	"uid":       {use: optionForMemfs, takesValue: true},
+	"gid":       {use: optionForMemfs, takesValue: true},
+}
+
+// Check the given -o mount options, and return the ones to pass on to the
+// kernel. Unknown options, and options with a missing or unexpected value,
+// are an error.
+func kernelMountOptions(
+	options map[string]string) (kernel map[string]string, err error) {
+	// Look at the options in order, so that errors are deterministic.
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	kernel = make(map[string]string)
+	var unknown []string
+	for _, name := range names {
+		value := options[name]
+
+		o, ok := mountOptions[name]
+		if !ok {
+			unknown = append(unknown, name)
+			continue
+		}
+
+		switch {
+		case o.takesValue && value == "":
+			err = fmt.Errorf("Mount option %q requires a value", name)
+			return
+
+		case !o.takesValue && value != "":
+			err = fmt.Errorf("Mount option %q does not take a value", name)
+			return
+		}
+
+		if o.use&optionForKernel != 0 {
+			kernel[name] = value
+		}
+	}
+
+	if len(unknown) != 0 {
+		err = fmt.Errorf("Unknown mount options: %s", strings.Join(unknown, ", "))
+		return
+	}
+
+	return
+}
+
+// The size of a block, as counted by the tmpfs nr_blocks option.
+const tmpfsBlockSize = 4096
+
+// Apply the tmpfs options among the -o mount options to the arguments, taking
+// precedence over the corresponding flags. As with tmpfs, uid and gid only
+// set the owner of the root directory.
+func applyTmpfsOptions(args *mountArgs) (err error) {
+	options := args.MountOptions
+
+	if _, ok := options["size"]; ok {
+		if _, ok := options["nr_blocks"]; ok {
+			err = fmt.Errorf("Mount options size and nr_blocks cannot be used together")
+			return
+		}
+	}
+
+	if value, ok := options["size"]; ok {
+		args.Size, err = parseTmpfsSize(value, true)
+		if err != nil {
+			err = fmt.Errorf("Mount option size: %v", err)
+			return
+		}
+	}
+
+	if value, ok := options["nr_blocks"]; ok {
+		var blocks uint64
+		blocks, err = parseTmpfsSize(value, false)
+		if err == nil && blocks > math.MaxUint64/tmpfsBlockSize {
+			err = fmt.Errorf("Too large: %s", value)
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Mount option nr_blocks: %v", err)
+			return
+		}
+
+		args.Size = blocks * tmpfsBlockSize
+	}
+
+	if value, ok := options["nr_inodes"]; ok {
+		args.NrInodes, err = parseTmpfsSize(value, false)
+		if err != nil {
+			err = fmt.Errorf("Mount option nr_inodes: %v", err)
+			return
+		}
+	}
+
+	if value, ok := options["mode"]; ok {
+		args.DirMode, err = parseTmpfsMode(value)
+		if err != nil {
+			err = fmt.Errorf("Mount option mode: %v", err)
+			return
+		}
+	}
+
+	if value, ok := options["uid"]; ok {
+		args.RootUid, err = parseTmpfsID(value)
+		if err != nil {
+			err = fmt.Errorf("Mount option uid: %v", err)
+			return
+		}
+	}
+
+	if value, ok := options["gid"]; ok {
+		args.RootGid, err = parseTmpfsID(value)
+		if err != nil {
+			err = fmt.Errorf("Mount option gid: %v", err)
+			return
+		}
+	}
+
+	return
+}
+
+// Parse a number with an optional k, m, g, t, p or e suffix for binary
+// multiples, as tmpfs does. If percent is set, the number may instead be a
+// percentage of physical memory, as in 50%.
+func parseTmpfsSize(s string, percent bool) (n uint64, err error) {
+	if percent && strings.HasSuffix(s, "%") {
+		var pct uint64
+		pct, err = strconv.ParseUint(strings.TrimSuffix(s, "%"), 10, 64)
+		if err != nil {
+			err = fmt.Errorf("Invalid percentage: %s", s)
+			return
+		}
+
+		var total uint64
+		total, err = sysinfo.TotalMemory()
+		if err != nil {
+			err = fmt.Errorf("Finding the amount of memory: %v", err)
+			return
+		}
+
+		// Avoid overflow for large memories by dividing first, which is exact
+		// enough for memory sizes.
+		if total/100 != 0 && pct > math.MaxUint64/(total/100) {
+			err = fmt.Errorf("Too large: %s", s)
+			return
+		}
+
+		n = total / 100 * pct
+		return
+	}
+
+	shift := uint(0)
+	if i := strings.IndexByte("kmgtpe", lowerByte(s)); s != "" && i != -1 {
+		shift = 10 * uint(i+1)
+		s = s[:len(s)-1]
+	}
+
+	n, err = strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		err = fmt.Errorf("Invalid number: %s", s)
+		return
+	}
+
+	if n > math.MaxUint64>>shift {
+		err = fmt.Errorf("Too large: %s", s)
+		return
+	}
+
+	n <<= shift
+	return
+}
+
+// Return the last byte of s in lower case, or zero if s is empty.
+func lowerByte(s string) byte {
+	if s == "" {
+		return 0
+	}
+
+	c := s[len(s)-1]
+	if 'A' <= c && c <= 'Z' {
+		c += 'a' - 'A'
+	}
+
+	return c
+}
+
+// Parse an octal mode for the root directory, which may include the setuid,
+// setgid and sticky bits.
+func parseTmpfsMode(s string) (mode os.FileMode, err error) {
+	m, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || m&^07777 != 0 {
+		err = fmt.Errorf("Invalid mode: %s", s)
+		return
+	}
+
+	mode = os.FileMode(m & 0777)
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+
+	return
+}
+
+// Parse a numeric user or group ID.
+func parseTmpfsID(s string) (id int, err error) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		err = fmt.Errorf("Invalid ID: %s", s)
+		return
+	}
+
+	id = int(n)
+	return
+}
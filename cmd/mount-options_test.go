@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"os"
+
+	mountpkg "github.com/zbiljic/memfs/pkg/mount"
+	. "gopkg.in/check.v1"
+)
+
+func (s *TestSuite) TestKernelMountOptions(c *C) {
+	kernel, err := kernelMountOptions(map[string]string{
+		"allow_other": "",
+		"max_read":    "131072",
+		"noatime":     "",
+		"nodev":       "",
+	})
+
+	c.Assert(err, IsNil)
+	c.Assert(kernel, DeepEquals, map[string]string{
+		"allow_other": "",
+		"max_read":    "131072",
+		"nodev":       "",
+	})
+}
+
+func (s *TestSuite) TestKernelMountOptionsUnknown(c *C) {
+	_, err := kernelMountOptions(map[string]string{
+		"allow_other": "",
+		"taco":        "",
+		"burrito":     "",
+	})
+
+	c.Assert(err, ErrorMatches, "Unknown mount options: burrito, taco")
+}
+
+func (s *TestSuite) TestKernelMountOptionsReserved(c *C) {
+	_, err := kernelMountOptions(map[string]string{"user_id": "0"})
+	c.Assert(err, ErrorMatches, "Unknown mount options: user_id")
+}
+
+func (s *TestSuite) TestKernelMountOptionsValues(c *C) {
+	_, err := kernelMountOptions(map[string]string{"max_read": ""})
+	c.Assert(err, ErrorMatches, `Mount option "max_read" requires a value`)
+
+	_, err = kernelMountOptions(map[string]string{"allow_other": "1"})
+	c.Assert(err, ErrorMatches, `Mount option "allow_other" does not take a value`)
+}
+
+func (s *TestSuite) TestParseTmpfsSize(c *C) {
+	for in, want := range map[string]uint64{
+		"0":     0,
+		"4096":  4096,
+		"512k":  512 << 10,
+		"2g":    2 << 30,
+		"2G":    2 << 30,
+		"1t":    1 << 40,
+		"16384": 16384,
+	} {
+		n, err := parseTmpfsSize(in, true)
+		c.Assert(err, IsNil)
+		c.Check(n, Equals, want, Commentf("%s", in))
+	}
+
+	for _, in := range []string{"", "g", "-1", "2x", "1.5g", "16777216e"} {
+		_, err := parseTmpfsSize(in, true)
+		c.Check(err, NotNil, Commentf("%s", in))
+	}
+
+	_, err := parseTmpfsSize("50%", false)
+	c.Check(err, NotNil)
+}
+
+func (s *TestSuite) TestParseTmpfsSizePercent(c *C) {
+	half, err := parseTmpfsSize("50%", true)
+	c.Assert(err, IsNil)
+	c.Check(half > 0, Equals, true)
+
+	all, err := parseTmpfsSize("100%", true)
+	c.Assert(err, IsNil)
+	c.Check(all/2-half < 100, Equals, true)
+}
+
+func (s *TestSuite) TestParseTmpfsMode(c *C) {
+	mode, err := parseTmpfsMode("1777")
+	c.Assert(err, IsNil)
+	c.Check(mode, Equals, os.ModeSticky|0777)
+
+	mode, err = parseTmpfsMode("6755")
+	c.Assert(err, IsNil)
+	c.Check(mode, Equals, os.ModeSetuid|os.ModeSetgid|0755)
+
+	_, err = parseTmpfsMode("17777")
+	c.Check(err, NotNil)
+
+	_, err = parseTmpfsMode("888")
+	c.Check(err, NotNil)
+}
+
+func (s *TestSuite) TestApplyTmpfsOptions(c *C) {
+	args := &mountArgs{
+		MountOptions: make(map[string]string),
+		RootUid:      -1,
+		RootGid:      -1,
+	}
+	mountpkg.ParseOptions(args.MountOptions, "size=2g,nr_inodes=1k,mode=1777,uid=1000,gid=100")
+
+	c.Assert(applyTmpfsOptions(args), IsNil)
+	c.Check(args.Size, Equals, uint64(2<<30))
+	c.Check(args.NrInodes, Equals, uint64(1024))
+	c.Check(args.DirMode, Equals, os.ModeSticky|0777)
+	c.Check(args.RootUid, Equals, 1000)
+	c.Check(args.RootGid, Equals, 100)
+
+	kernel, err := kernelMountOptions(args.MountOptions)
+	c.Assert(err, IsNil)
+	c.Check(kernel, HasLen, 0)
+}
+
+func (s *TestSuite) TestApplyTmpfsOptionsBlocks(c *C) {
+	args := &mountArgs{MountOptions: map[string]string{"nr_blocks": "10"}}
+	c.Assert(applyTmpfsOptions(args), IsNil)
+	c.Check(args.Size, Equals, uint64(10*4096))
+
+	args.MountOptions["size"] = "1m"
+	c.Check(applyTmpfsOptions(args), NotNil)
+}
+
+func (s *TestSuite) TestKernelMountOptionsReadOnly(c *C) {
+	// Read-only mode is up to memfs, so it can be switched off again.
+	kernel, err := kernelMountOptions(map[string]string{"ro": ""})
+	c.Assert(err, IsNil)
+	c.Check(kernel, HasLen, 0)
+}
@@ -0,0 +1,196 @@
+package filesystem
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// Access bits, as in the rwx triplets of a mode.
+const (
+	accessRead  = 04
+	accessWrite = 02
+	accessExec  = 01
+)
+
+// Return the access bits to check for opening a file with the given flags.
+func accessForFlags(flags fuseops.OpenFlags) (want uint32) {
+	switch int(flags) & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		want = accessRead
+	case syscall.O_WRONLY:
+		want = accessWrite
+	default:
+		want = accessRead | accessWrite
+	}
+
+	if int(flags)&syscall.O_TRUNC != 0 {
+		want |= accessWrite
+	}
+
+	return
+}
+
+// Return EACCES unless the caller described by the op context may access the
+// inode in all the ways in want, according to the owner, group and other bits
+// of its mode. Root may do anything but execute a file with no execute bits
+// set.
+//
+// LOCKS_REQUIRED(in.mu)
+func checkAccess(
+	opCtx fuseops.OpContext,
+	in *inode,
+	want uint32) (err error) {
+	perm := uint32(in.attrs.Mode.Perm())
+
+	if opCtx.Uid == 0 {
+		if want&accessExec != 0 && !in.isDir() && perm&0111 == 0 {
+			err = syscall.EACCES
+		}
+
+		return
+	}
+
+	// Pick the class the caller falls into. Supplementary groups only matter
+	// if the group bits grant something different from the other bits.
+	var granted uint32
+	switch {
+	case opCtx.Uid == in.attrs.Uid:
+		granted = perm >> 6
+	case (perm>>3)&07 != perm&07 && inGroup(opCtx, in.attrs.Gid):
+		granted = perm >> 3
+	default:
+		granted = perm
+	}
+
+	if want&^granted&07 != 0 {
+		err = syscall.EACCES
+	}
+
+	return
+}
+
+// Return EPERM unless the caller owns the inode or is root.
+//
+// LOCKS_REQUIRED(in.mu)
+func checkOwner(opCtx fuseops.OpContext, in *inode) (err error) {
+	if opCtx.Uid != 0 && opCtx.Uid != in.attrs.Uid {
+		err = syscall.EPERM
+	}
+
+	return
+}
+
+// Return EPERM if the directory is sticky and the caller may therefore not
+// remove or rename the child in it. In a sticky directory, only root and the
+// owners of the directory and of the child may do that.
+//
+// LOCKS_REQUIRED(dir.mu)
+// LOCKS_REQUIRED(child.mu)
+func checkSticky(opCtx fuseops.OpContext, dir *inode, child *inode) (err error) {
+	if dir.attrs.Mode&os.ModeSticky == 0 || opCtx.Uid == 0 {
+		return
+	}
+
+	if opCtx.Uid != dir.attrs.Uid && opCtx.Uid != child.attrs.Uid {
+		err = syscall.EPERM
+	}
+
+	return
+}
+
+// Return EPERM unless the caller may change the owner and group of the inode
+// to the non-nil values given. Only root may give a file away, and otherwise
+// only the owner may change the group, to one they are a member of.
+//
+// LOCKS_REQUIRED(in.mu)
+func checkChown(
+	opCtx fuseops.OpContext,
+	in *inode,
+	uid *uint32,
+	gid *uint32) (err error) {
+	if opCtx.Uid == 0 {
+		return
+	}
+
+	if opCtx.Uid != in.attrs.Uid {
+		err = syscall.EPERM
+		return
+	}
+
+	if uid != nil && *uid != in.attrs.Uid {
+		err = syscall.EPERM
+		return
+	}
+
+	if gid != nil && *gid != in.attrs.Gid && !inGroup(opCtx, *gid) {
+		err = syscall.EPERM
+		return
+	}
+
+	return
+}
+
+// Is the caller a member of the given group, either as its primary group or
+// as a supplementary group of the calling process?
+func inGroup(opCtx fuseops.OpContext, gid uint32) bool {
+	if opCtx.Gid == gid {
+		return true
+	}
+
+	groups, err := processGroups(opCtx.Pid)
+	if err != nil {
+		return false
+	}
+
+	for _, g := range groups {
+		if g == gid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Read the supplementary groups of the given process from /proc. This fails
+// where there is no /proc, in which case only the primary group counts.
+func processGroups(pid uint32) (groups []uint32, err error) {
+	if pid == 0 {
+		err = fmt.Errorf("No process")
+		return
+	}
+
+	f, err := os.Open(fmt.Sprintf("/proc/%d/status", pid))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "Groups:") {
+			continue
+		}
+
+		for _, field := range strings.Fields(strings.TrimPrefix(line, "Groups:")) {
+			var g uint64
+			g, err = strconv.ParseUint(field, 10, 32)
+			if err != nil {
+				return
+			}
+
+			groups = append(groups, uint32(g))
+		}
+
+		return
+	}
+
+	err = scanner.Err()
+	return
+}
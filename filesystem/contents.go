@@ -0,0 +1,334 @@
+package filesystem
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// The size of the pages file contents are stored in.
+const pageSize = 4096
+
+// What holes read as when handed out by slices. Never written to.
+var zeroPage = make([]byte, pageSize)
+
+// The contents of a file, stored as fixed-size pages. Pages that have never
+// been written, including any in a hole left by seeking past the end or
+// extending the file, take no memory and read as zeros.
+//
+// Pages may also be allocated ahead of time, including past the end of the
+// file, by fallocate. The contents don't know the size of the file; callers
+// pass it in where it matters.
+//
+// Pages may be lent out by slices, to be read after the caller has given up
+// its lock. A lent page is never modified again; anything that would modify
+// it first replaces it with a copy, leaving the original to whoever borrowed
+// it. Borrowers don't say when they are done, so a page stays lent until it
+// is replaced, and the first write after each lending pays for a copy.
+//
+// External synchronization is required. Readers holding a shared lock may
+// lend pages concurrently, so lent has a lock of its own too.
+type fileContents struct {
+	// Pages keyed by their index within the file.
+	//
+	// INVARIANT: For each value p, len(p) == pageSize
+	pages map[int64][]byte
+
+	// The indices of pages that have been lent out since they were last
+	// replaced.
+	//
+	// INVARIANT: For each key i, pages[i] exists
+	lent   map[int64]struct{} // GUARDED_BY(lentMu)
+	lentMu sync.Mutex
+}
+
+// Return the number of bytes of memory held by the pages.
+func (c *fileContents) allocated() uint64 {
+	return uint64(len(c.pages)) * pageSize
+}
+
+// Return the number of bytes of memory that writing n bytes at off would
+// allocate.
+func (c *fileContents) allocationFor(off int64, n int64) (bytes uint64) {
+	if n == 0 {
+		return
+	}
+
+	first, last := off/pageSize, (off+n-1)/pageSize
+	bytes = uint64(last-first+1) * pageSize
+	c.eachPage(first, last, func(int64) {
+		bytes -= pageSize
+	})
+
+	return
+}
+
+// Call f with the index of each allocated page in [first, last], in no
+// particular order. f may delete the page it is given. Ranges given to
+// fallocate may be far larger than the file, so this looks at whichever of
+// the range and the pages is smaller.
+func (c *fileContents) eachPage(first int64, last int64, f func(i int64)) {
+	if last-first+1 > int64(len(c.pages)) {
+		for i := range c.pages {
+			if first <= i && i <= last {
+				f(i)
+			}
+		}
+
+		return
+	}
+
+	for i := first; i <= last; i++ {
+		if _, ok := c.pages[i]; ok {
+			f(i)
+		}
+	}
+}
+
+// Copy the contents at off into p, filling holes with zeros. The caller is
+// responsible for not reading past the end of the file.
+func (c *fileContents) readAt(p []byte, off int64) {
+	for len(p) > 0 {
+		i, pageOff := off/pageSize, off%pageSize
+
+		var n int
+		if page, ok := c.pages[i]; ok {
+			n = copy(p, page[pageOff:])
+		} else {
+			n = len(p)
+			if rest := int(pageSize - pageOff); n > rest {
+				n = rest
+			}
+
+			for j := range p[:n] {
+				p[j] = 0
+			}
+		}
+
+		p = p[n:]
+		off += int64(n)
+	}
+}
+
+// Return the n bytes of contents at off as slices of the pages themselves,
+// with holes as slices of zeroPage. The pages are lent out, so the slices
+// stay valid and unchanged for as long as the caller likes, without holding
+// any lock. The caller is responsible for not reading past the end of the
+// file.
+func (c *fileContents) slices(off int64, n int64) (data [][]byte) {
+	c.lentMu.Lock()
+	defer c.lentMu.Unlock()
+
+	for n > 0 {
+		i, pageOff := off/pageSize, off%pageSize
+
+		end := int64(pageSize)
+		if rest := pageOff + n; end > rest {
+			end = rest
+		}
+
+		if page, ok := c.pages[i]; ok {
+			if c.lent == nil {
+				c.lent = make(map[int64]struct{})
+			}
+
+			c.lent[i] = struct{}{}
+			data = append(data, page[pageOff:end])
+		} else {
+			data = append(data, zeroPage[pageOff:end])
+		}
+
+		n -= end - pageOff
+		off += end - pageOff
+	}
+
+	return
+}
+
+// Return page i, ready to be modified, or nil if it doesn't exist. If it has
+// been lent out, it is first replaced with a copy.
+//
+// This must not be called while readers may be lending pages.
+func (c *fileContents) modifiablePage(i int64) (page []byte) {
+	page, ok := c.pages[i]
+	if !ok {
+		return
+	}
+
+	if _, ok := c.lent[i]; ok {
+		page = append([]byte(nil), page...)
+		c.pages[i] = page
+		delete(c.lent, i)
+	}
+
+	return
+}
+
+// Drop page i, which must exist.
+func (c *fileContents) deletePage(i int64) {
+	delete(c.pages, i)
+	delete(c.lent, i)
+}
+
+// Copy p into the contents at off, allocating pages as necessary.
+func (c *fileContents) writeAt(p []byte, off int64) {
+	for len(p) > 0 {
+		i, pageOff := off/pageSize, off%pageSize
+
+		page := c.modifiablePage(i)
+		if page == nil {
+			if c.pages == nil {
+				c.pages = make(map[int64][]byte)
+			}
+
+			page = make([]byte, pageSize)
+			c.pages[i] = page
+		}
+
+		n := copy(page[pageOff:], p)
+		p = p[n:]
+		off += int64(n)
+	}
+}
+
+// Allocate zeroed pages for any holes in the n bytes at off, leaving existing
+// data alone.
+func (c *fileContents) allocate(off int64, n int64) {
+	if n == 0 {
+		return
+	}
+
+	if c.pages == nil {
+		c.pages = make(map[int64][]byte)
+	}
+
+	for i := off / pageSize; i <= (off+n-1)/pageSize; i++ {
+		if _, ok := c.pages[i]; !ok {
+			c.pages[i] = make([]byte, pageSize)
+		}
+	}
+}
+
+// Zero the n bytes at off. Pages wholly within the range are released,
+// leaving a hole. Return the number of bytes of memory released.
+func (c *fileContents) punchHole(off int64, n int64) (released uint64) {
+	if n == 0 {
+		return
+	}
+
+	end := off + n
+
+	// Zero the parts of the pages at either end that lie within the range.
+	for _, i := range []int64{off / pageSize, (end - 1) / pageSize} {
+		start := i * pageSize
+		if start >= off && start+pageSize <= end {
+			continue
+		}
+
+		if page := c.modifiablePage(i); page != nil {
+			from, to := start, start+pageSize
+			if from < off {
+				from = off
+			}
+
+			if to > end {
+				to = end
+			}
+
+			zeroed := page[from-start : to-start]
+			for j := range zeroed {
+				zeroed[j] = 0
+			}
+		}
+	}
+
+	// Release the pages in between.
+	first := (off + pageSize - 1) / pageSize
+	last := end/pageSize - 1
+	if first <= last {
+		c.eachPage(first, last, func(i int64) {
+			c.deletePage(i)
+			released += pageSize
+		})
+	}
+
+	return
+}
+
+// Discard the contents at and beyond size, releasing pages wholly past it.
+// Return the number of bytes of memory released.
+func (c *fileContents) truncate(size uint64) (released uint64) {
+	// Zero the tail of the page the file now ends in, so that extending the
+	// file again reads zeros.
+	last := int64(size / pageSize)
+	if size%pageSize == 0 {
+		if _, ok := c.pages[last]; ok {
+			c.deletePage(last)
+			released += pageSize
+		}
+	} else if page := c.modifiablePage(last); page != nil {
+		tail := page[size%pageSize:]
+		for j := range tail {
+			tail[j] = 0
+		}
+	}
+
+	for i := range c.pages {
+		if i > last {
+			c.deletePage(i)
+			released += pageSize
+		}
+	}
+
+	return
+}
+
+// Return the indices of the allocated pages in increasing order.
+func (c *fileContents) pageIndices() (indices []int64) {
+	for i := range c.pages {
+		indices = append(indices, i)
+	}
+
+	sort.Slice(indices, func(a, b int) bool { return indices[a] < indices[b] })
+	return
+}
+
+// Panic if the contents are inconsistent with a file of the given size.
+func (c *fileContents) checkInvariants(size uint64) {
+	c.lentMu.Lock()
+	defer c.lentMu.Unlock()
+
+	// INVARIANT: For each key i, pages[i] exists
+	for i := range c.lent {
+		if _, ok := c.pages[i]; !ok {
+			panic(fmt.Sprintf("Lent page %d doesn't exist", i))
+		}
+	}
+
+	for i, page := range c.pages {
+		// INVARIANT: For each value p, len(p) == pageSize
+		if len(page) != pageSize {
+			panic(fmt.Sprintf("Unexpected length for page %d: %d", i, len(page)))
+		}
+
+		if i < 0 {
+			panic(fmt.Sprintf("Negative page index: %d", i))
+		}
+
+		// Pages may have been preallocated past the end of the file, but
+		// everything past the end reads as zero.
+		start := uint64(i) * pageSize
+		if start >= size || size-start < pageSize {
+			var from uint64
+			if start < size {
+				from = size - start
+			}
+
+			for _, b := range page[from:] {
+				if b != 0 {
+					panic(fmt.Sprintf("Non-zero data past end of file in page %d", i))
+				}
+			}
+		}
+	}
+}
@@ -4,7 +4,11 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"log"
+	"math"
 	"os"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -12,58 +16,217 @@ import (
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
 	"github.com/jacobsa/syncutil"
+	"golang.org/x/sys/unix"
+)
+
+// AtimeMode selects when reads update the access time of an inode.
+type AtimeMode int
+
+const (
+	// Update the access time if the inode has been modified or changed since
+	// it was last read, or if the access time is at least a day old. This is
+	// the default, as with the relatime mount option.
+	AtimeRelative AtimeMode = iota
+
+	// Update the access time on every read, as with strictatime.
+	AtimeStrict
+
+	// Never update the access time on reads, as with noatime.
+	AtimeNever
 )
 
 type ServerConfig struct {
-	// The UID and GID that owns all inodes in the file system.
+	// The UID and GID that own the root directory.
 	Uid uint32
 	Gid uint32
 
+	// If set, new inodes are owned by Uid or Gid respectively, rather than by
+	// the caller that creates them.
+	ForceUid bool
+	ForceGid bool
+
 	// Permissions bits to use for files and directories. No bits outside of
-	// os.ModePerm may be set.
+	// os.ModePerm may be set, except that DirPerms, which applies to the root
+	// directory, may also have the setuid, setgid and sticky bits. A zero
+	// DirPerms gives the root directory 0700.
 	FilePerms os.FileMode
 	DirPerms  os.FileMode
+
+	// When reads update the access time.
+	AtimeMode AtimeMode
+
+	// How long the kernel may cache the attributes of inodes, the entries of
+	// directories, and the absence of names from directories. A zero
+	// NegativeTimeout means that failed lookups are not cached at all.
+	AttrTimeout     time.Duration
+	EntryTimeout    time.Duration
+	NegativeTimeout time.Duration
+
+	// If set, the file system starts out read-only, rejecting every change
+	// with EROFS. See Server.SetReadOnly.
+	ReadOnly bool
+
+	// Whether the kernel is mounting us with writeback caching, in which case
+	// it buffers writes in its page cache and sends them to us in batches.
+	WritebackCache bool
+
+	// The maximum number of bytes of file contents the file system may hold,
+	// not counting holes in sparse files. Zero means no limit.
+	SizeLimit uint64
+
+	// The maximum number of inodes, including the root, the file system may
+	// hold. Zero means no limit.
+	InodeLimit uint64
+
+	// If set, the file system starts out with the contents of the snapshot in
+	// this file instead of an empty root directory.
+	SnapshotFile string
+
+	// If set, every change is logged to this journal file, and syncing a file
+	// makes the log durable. The file system starts out with the contents of
+	// the last checkpoint, kept next to the journal, plus the journal.
+	JournalFile string
+}
+
+// Server is a fuse file system server that keeps its file system in memory.
+type Server struct {
+	fuse.Server
+
+	fs *fileSystem
 }
 
 // NewServer creates a fuse file system server according to the supplied
 // configuration.
-func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
+func NewServer(cfg *ServerConfig) (server *Server, err error) {
 	// Check permissions bits.
 	if cfg.FilePerms&^os.ModePerm != 0 {
 		err = fmt.Errorf("Illegal file perms: %v", cfg.FilePerms)
 		return
 	}
 
-	if cfg.DirPerms&^os.ModePerm != 0 {
-		err = fmt.Errorf("Illegal dir perms: %v", cfg.FilePerms)
+	if cfg.DirPerms&^(os.ModePerm|inodeSpecialBits) != 0 {
+		err = fmt.Errorf("Illegal dir perms: %v", cfg.DirPerms)
 		return
 	}
 
 	// Set up the basic struct.
 	fs := &fileSystem{
-		uid:      cfg.Uid,
-		gid:      cfg.Gid,
-		fileMode: cfg.FilePerms,
-		dirMode:  cfg.DirPerms | os.ModeDir,
-		inodes:   make([]*inode, fuseops.RootInodeID+1),
+		uid:             cfg.Uid,
+		gid:             cfg.Gid,
+		forceUid:        cfg.ForceUid,
+		forceGid:        cfg.ForceGid,
+		atimeMode:       cfg.AtimeMode,
+		attrTimeout:     cfg.AttrTimeout,
+		entryTimeout:    cfg.EntryTimeout,
+		negativeTimeout: cfg.NegativeTimeout,
+		writebackCache:  cfg.WritebackCache,
+		fileMode:        cfg.FilePerms,
+		dirMode:         cfg.DirPerms | os.ModeDir,
+		sizeLimit:       cfg.SizeLimit,
+		inodeLimit:      cfg.InodeLimit,
+		inodes:          make([]*inode, fuseops.RootInodeID+1),
+		fileHandles:     make(map[fuseops.HandleID]*fileHandle),
+		dirHandles:      make(map[fuseops.HandleID]*dirHandle),
+
+		checkpointMinJournalSize: checkpointMinJournalSize,
+	}
+
+	if cfg.ReadOnly {
+		fs.readOnly = 1
 	}
 
 	// Set up the root inode.
+	if cfg.DirPerms == 0 {
+		fs.dirMode = 0700 | os.ModeDir
+	}
+
 	rootAttrs := fuseops.InodeAttributes{
-		Mode: 0700 | fs.dirMode,
-		Uid:  fs.uid,
-		Gid:  fs.gid,
+		Nlink: 2,
+		Mode:  fs.dirMode,
+		Uid:   fs.uid,
+		Gid:   fs.gid,
 	}
 
 	root := newInode(rootAttrs)
 
 	fs.inodes[fuseops.RootInodeID] = root
+	fs.updateCounts()
 
 	// Set up invariant checking.
-	fs.mu = syncutil.NewInvariantMutex(fs.checkInvariants)
+	fs.mu = syncutil.NewInvariantMutex(invariantCheck(fs.checkInvariants))
+
+	// Restore the snapshot, if any.
+	if cfg.SnapshotFile != "" {
+		err = fs.loadSnapshot(cfg.SnapshotFile)
+		if err != nil {
+			return
+		}
+
+		fs.freeUnreachableInodes()
+	}
+
+	// Recover from the journal, if any, and keep it from growing without
+	// bound.
+	if cfg.JournalFile != "" {
+		err = fs.recoverJournal(cfg.JournalFile)
+		if err != nil {
+			return
+		}
+
+		fs.checkpointRequests = make(chan struct{}, 1)
+		fs.checkpointDone = make(chan struct{})
+		go fs.checkpointLoop()
+	}
 
 	// Update stats.
-	server = fuseutil.NewFileSystemServer(fs)
+	server = &Server{
+		Server: fuseutil.NewFileSystemServer(recoveringFileSystem{fs}),
+		fs:     fs,
+	}
+	return
+}
+
+// SetReadOnly switches the file system between read-only and read-write while
+// it is mounted. Changes already under way when it becomes read-only still
+// complete, but every later one fails with EROFS. Files already open for
+// writing stay open, though writing to them fails too. With writeback caching,
+// data still in the kernel's cache can't be written back once the file system
+// is read-only, so writers should sync it first.
+func (s *Server) SetReadOnly(readOnly bool) {
+	var v uint32
+	if readOnly {
+		v = 1
+	}
+
+	atomic.StoreUint32(&s.fs.readOnly, v)
+}
+
+// ReadOnly returns whether the file system is currently read-only.
+func (s *Server) ReadOnly() bool {
+	return atomic.LoadUint32(&s.fs.readOnly) != 0
+}
+
+// Close writes a final checkpoint and closes the journal, if there is one. It
+// must be called only once the file system has been unmounted.
+func (s *Server) Close() (err error) {
+	if s.fs.checkpointRequests != nil {
+		close(s.fs.checkpointRequests)
+		<-s.fs.checkpointDone
+	}
+
+	if s.fs.journal == nil {
+		return
+	}
+
+	// Close the journal even if the checkpoint fails, reporting the first
+	// error.
+	err = s.fs.checkpoint()
+	if closeErr := s.fs.journal.close(); err == nil {
+		err = closeErr
+	}
+
+	s.fs.journal = nil
+
 	return
 }
 
@@ -71,34 +234,75 @@ func NewServer(cfg *ServerConfig) (server fuse.Server, err error) {
 // fileSystem type
 ////////////////////////////////////////////////////////////////////////
 
+// Locks are acquired in the following order:
+//
+//  1. fs.opsMu
+//  2. fs.renameMu
+//  3. The locks of directory inodes, ancestors before descendants. Unrelated
+//     directories are only ever locked together by Rename, which holds
+//     fs.renameMu and locks them in order of inode ID.
+//  4. The locks of the entries being operated on within those directories, in
+//     order of inode ID.
+//  5. fs.mu
+//  6. The journal's lock.
 type fileSystem struct {
 	fuseutil.NotImplementedFileSystem
 
-	// The UID and GID that every inode receives.
-	uid uint32
-	gid uint32
+	// The UID and GID that own the root directory, and that override the
+	// caller's credentials for new inodes if forceUid or forceGid is set.
+	uid      uint32
+	gid      uint32
+	forceUid bool
+	forceGid bool
 
 	// Mode bits for all inodes.
 	fileMode os.FileMode
 	dirMode  os.FileMode
 
+	// When reads update the access time.
+	atimeMode AtimeMode
+
+	// How long the kernel may cache attributes, entries and failed lookups.
+	attrTimeout     time.Duration
+	entryTimeout    time.Duration
+	negativeTimeout time.Duration
+
+	// Whether the kernel caches writes and sends them to us in batches.
+	writebackCache bool
+
+	// Non-zero while the file system is read-only. Accessed atomically, since
+	// it may change at any time.
+	readOnly uint32
+
+	// Capacity limits. Zero means no limit.
+	sizeLimit  uint64
+	inodeLimit uint64
+
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
 
+	// Held for reading by every op while it runs, and for writing while a
+	// checkpoint is written in the background, so that the checkpoint sees a
+	// consistent state.
+	opsMu sync.RWMutex
+
+	// Serializes renames between different directories, so that the shape of
+	// the directory tree can't change while Rename decides which order to lock
+	// the two parents in.
+	renameMu sync.Mutex
+
+	// Guards the inode and handle tables. Each inode is guarded by its own
+	// lock.
 	mu syncutil.InvariantMutex
 
 	// The collection of live inodes, indexed by ID. IDs of free inodes that may
 	// be re-used have nil entries. No ID less than fuseops.RootInodeID is ever
 	// used.
 	//
-	// All inodes are protected by the file system mutex.
-	//
-	// INVARIANT: For each inode in, in.CheckInvariants() does not panic.
 	// INVARIANT: len(inodes) > fuseops.RootInodeID
 	// INVARIANT: For all i < fuseops.RootInodeID, inodes[i] == nil
 	// INVARIANT: inodes[fuseops.RootInodeID] != nil
-	// INVARIANT: inodes[fuseops.RootInodeID].isDir()
 	inodes []*inode // GUARDED_BY(mu)
 
 	// A list of inode IDs within inodes available for reuse, not including the
@@ -107,12 +311,53 @@ type fileSystem struct {
 	// INVARIANT: This is all and only indices i of 'inodes' such that i >
 	// fuseops.RootInodeID and inodes[i] == nil
 	freeInodes []fuseops.InodeID // GUARDED_BY(mu)
+
+	// The open file and directory handles. Handle IDs are never reused.
+	//
+	// INVARIANT: Each handle refers to a live inode
+	fileHandles map[fuseops.HandleID]*fileHandle // GUARDED_BY(mu)
+	dirHandles  map[fuseops.HandleID]*dirHandle  // GUARDED_BY(mu)
+	lastHandle  fuseops.HandleID                 // GUARDED_BY(mu)
+
+	// Copies of liveInodes() and the number of open handles, for summary,
+	// which can't take mu. Written with mu held and accessed atomically.
+	numInodes  uint64
+	numHandles uint64
+
+	// The number of bytes of memory held by the contents of live inodes.
+	// Accessed atomically.
+	//
+	// INVARIANT: This is the sum of in.contents.allocated() over all live inodes
+	// INVARIANT: If sizeLimit != 0, usedBytes <= sizeLimit
+	usedBytes uint64
+
+	// The journal that changes are logged to, or nil if journaling is off. The
+	// journal continues the checkpoint at journalPath+checkpointSuffix, which
+	// has the same generation.
+	//
+	// These are only replaced while no op is running: before the file system
+	// is served, or with opsMu held for writing. So ops may read them without
+	// locking.
+	journal           *journal
+	journalPath       string
+	journalGeneration uint64
+
+	// The size the journal must reach before a background checkpoint, at the
+	// least.
+	checkpointMinJournalSize int64
+
+	// Requests for a background checkpoint, and closed once no more will be
+	// made. checkpointDone is closed once the last one has been handled. Both
+	// are nil if journaling is off.
+	checkpointRequests chan struct{}
+	checkpointDone     chan struct{}
 }
 
 ////////////////////////////////////////////////////////////////////////
 // Helpers
 ////////////////////////////////////////////////////////////////////////
 
+// LOCKS_REQUIRED(fs.mu)
 func (fs *fileSystem) checkInvariants() {
 	// Check reserved inodes.
 	for i := 0; i < fuseops.RootInodeID; i++ {
@@ -122,8 +367,8 @@ func (fs *fileSystem) checkInvariants() {
 	}
 
 	// Check the root inode.
-	if !fs.inodes[fuseops.RootInodeID].isDir() {
-		panic("Expected root to be a directory.")
+	if fs.inodes[fuseops.RootInodeID] == nil {
+		panic("Missing root inode.")
 	}
 
 	// Build our own list of free IDs.
@@ -151,29 +396,204 @@ func (fs *fileSystem) checkInvariants() {
 		}
 	}
 
-	// INVARIANT: For each inode in, in.CheckInvariants() does not panic.
-	for _, in := range fs.inodes {
-		in.CheckInvariants()
+	// INVARIANT: Each handle refers to a live inode
+	fs.checkHandleInvariants()
+
+	// Check fs.usedBytes. The inodes themselves are checked by their own locks,
+	// and summing their contents here would race with writers.
+	usedBytes := atomic.LoadUint64(&fs.usedBytes)
+	if fs.sizeLimit != 0 && usedBytes > fs.sizeLimit {
+		panic(
+			fmt.Sprintf(
+				"Used bytes over limit: %v vs. %v",
+				usedBytes,
+				fs.sizeLimit))
 	}
 }
 
-// Find the given inode. Panic if it doesn't exist.
+// Return the owner for an inode created by the given caller.
+func (fs *fileSystem) newOwner(opCtx fuseops.OpContext) (uid, gid uint32) {
+	uid, gid = opCtx.Uid, opCtx.Gid
+	if fs.forceUid {
+		uid = fs.uid
+	}
+
+	if fs.forceGid {
+		gid = fs.gid
+	}
+
+	return
+}
+
+// Find the given inode, or nil if the ID is not in use.
 //
-// LOCKS_REQUIRED(fs.mu)
-func (fs *fileSystem) getInodeOrDie(id fuseops.InodeID) (inode *inode) {
-	inode = fs.inodes[id]
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) getInode(id fuseops.InodeID) (inode *inode) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if int(id) < len(fs.inodes) {
+		inode = fs.inodes[id]
+	}
+
+	return
+}
+
+// Fill in how long the kernel may cache the entry and the attributes in it.
+// We don't spontaneously mutate, and the kernel handles invalidation for the
+// changes it makes, so this is purely a matter of policy.
+func (fs *fileSystem) setExpiration(entry *fuseops.ChildInodeEntry) {
+	now := time.Now()
+	entry.AttributesExpiration = now.Add(fs.attrTimeout)
+	entry.EntryExpiration = now.Add(fs.entryTimeout)
+}
+
+// Return EROFS if the file system is currently read-only.
+func (fs *fileSystem) checkWritable() (err error) {
+	if atomic.LoadUint32(&fs.readOnly) != 0 {
+		err = syscall.EROFS
+	}
+
+	return
+}
+
+// The longest name a directory entry may have.
+const maxNameLength = 255
+
+// Return ENAMETOOLONG if the name is too long for a directory entry.
+func checkName(name string) (err error) {
+	if len(name) > maxNameLength {
+		err = syscall.ENAMETOOLONG
+	}
+
+	return
+}
+
+// Find the given inode. Return ENOENT if it doesn't exist, which means that
+// something screwed up earlier (a lookup, a cache invalidation, etc.), since
+// we don't mutate spontaneously.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) findInode(id fuseops.InodeID) (inode *inode, err error) {
+	inode = fs.getInode(id)
 	if inode == nil {
-		panic(fmt.Sprintf("Unknown inode: %v", id))
+		err = fuse.ENOENT
 	}
 
 	return
 }
 
-// Allocate a new inode, assigning it an ID that is not in use.
+// Return the number of live inodes, including the root.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) liveInodes() uint64 {
+	return uint64(len(fs.inodes) - fuseops.RootInodeID - len(fs.freeInodes))
+}
+
+// Refresh fs.numInodes and fs.numHandles after a change to the tables.
 //
 // LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) updateCounts() {
+	atomic.StoreUint64(&fs.numInodes, fs.liveInodes())
+	atomic.StoreUint64(
+		&fs.numHandles,
+		uint64(len(fs.fileHandles)+len(fs.dirHandles)))
+}
+
+// Account for n more bytes of file contents. Return ENOSPC, without updating
+// anything, if that would exceed the size limit.
+func (fs *fileSystem) reserveBytes(n uint64) (err error) {
+	for {
+		used := atomic.LoadUint64(&fs.usedBytes)
+		if fs.sizeLimit != 0 && n > fs.sizeLimit-used {
+			err = syscall.ENOSPC
+			return
+		}
+
+		if atomic.CompareAndSwapUint64(&fs.usedBytes, used, used+n) {
+			return
+		}
+	}
+}
+
+// Account for n bytes of file contents having been freed.
+func (fs *fileSystem) releaseBytes(n uint64) {
+	atomic.AddUint64(&fs.usedBytes, -n)
+}
+
+// Write p to the file at off, reserving space for any pages the write
+// allocates first.
+//
+// LOCKS_REQUIRED(in.mu)
+func (fs *fileSystem) writeContents(in *inode, p []byte, off int64) (err error) {
+	err = fs.reserveBytes(in.contents.allocationFor(off, int64(len(p))))
+	if err != nil {
+		return
+	}
+
+	_, err = in.WriteAt(p, off)
+	return
+}
+
+// Change the size of the file, releasing the space of any pages dropped.
+//
+// LOCKS_REQUIRED(in.mu)
+func (fs *fileSystem) truncateContents(in *inode, size uint64) {
+	before := in.contents.allocated()
+	in.SetAttributes(&size, nil, nil, nil)
+	fs.releaseBytes(before - in.contents.allocated())
+}
+
+// Make sure the n bytes of the file at off are backed by pages, reserving
+// space for any new ones first. If zero is set, the range is zeroed as well.
+//
+// LOCKS_REQUIRED(in.mu)
+func (fs *fileSystem) allocateContents(
+	in *inode,
+	off int64,
+	n int64,
+	zero bool) (err error) {
+	err = fs.reserveBytes(in.contents.allocationFor(off, n))
+	if err != nil {
+		return
+	}
+
+	// Pages released by the hole are allocated again below, so their space
+	// stays reserved.
+	if zero {
+		in.contents.punchHole(off, n)
+	}
+
+	in.contents.allocate(off, n)
+	return
+}
+
+// Zero the n bytes of the file at off, releasing the space of the pages
+// wholly within the range.
+//
+// LOCKS_REQUIRED(in.mu)
+func (fs *fileSystem) punchContents(in *inode, off int64, n int64) {
+	fs.releaseBytes(in.contents.punchHole(off, n))
+}
+
+// Allocate a new inode, assigning it an ID that is not in use. Return ENOSPC
+// if that would exceed the inode limit.
+//
+// The kernel doesn't know about the new inode until the caller tells it, so
+// the caller may finish setting it up without locking it.
+//
+// LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) allocateInode(
-	attrs fuseops.InodeAttributes) (id fuseops.InodeID, inode *inode) {
+	attrs fuseops.InodeAttributes) (id fuseops.InodeID, inode *inode, err error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Make sure there is room for another inode.
+	if fs.inodeLimit != 0 && fs.liveInodes() >= fs.inodeLimit {
+		err = syscall.ENOSPC
+		return
+	}
+
 	// Create the inode.
 	inode = newInode(attrs)
 
@@ -188,13 +608,171 @@ func (fs *fileSystem) allocateInode(
 		fs.inodes = append(fs.inodes, inode)
 	}
 
+	fs.updateCounts()
+
+	return
+}
+
+// Allocate a new inode at the given ID, which must not be in use.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) allocateInodeAt(
+	id fuseops.InodeID,
+	attrs fuseops.InodeAttributes) (inode *inode) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Mint any IDs up to the given one as free.
+	for fuseops.InodeID(len(fs.inodes)) <= id {
+		fs.freeInodes = append(fs.freeInodes, fuseops.InodeID(len(fs.inodes)))
+		fs.inodes = append(fs.inodes, nil)
+	}
+
+	// Take the ID off the free list.
+	for i, freeID := range fs.freeInodes {
+		if freeID == id {
+			fs.freeInodes = append(fs.freeInodes[:i], fs.freeInodes[i+1:]...)
+			break
+		}
+	}
+
+	inode = newInode(attrs)
+	fs.inodes[id] = inode
+	fs.updateCounts()
+
 	return
 }
 
-// LOCKS_REQUIRED(fs.mu)
-func (fs *fileSystem) deallocateInode(id fuseops.InodeID) {
+// Free the given inode if neither a directory entry nor the kernel refers to
+// it anymore. The root inode is never freed.
+//
+// LOCKS_REQUIRED(in.mu)
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) maybeDeallocateInode(id fuseops.InodeID, in *inode) {
+	if id == fuseops.RootInodeID || in.isReachable() {
+		return
+	}
+
+	fs.deallocateInode(id, in)
+}
+
+// Free every inode that nothing refers to anymore, as after loading a snapshot
+// taken while unlinked files were still open. This must be called only while
+// the file system is not being served.
+func (fs *fileSystem) freeUnreachableInodes() {
+	for i := fuseops.RootInodeID + 1; i < len(fs.inodes); i++ {
+		if in := fs.inodes[i]; in != nil {
+			fs.maybeDeallocateInode(fuseops.InodeID(i), in)
+		}
+	}
+}
+
+// Decrement the lookup count for the given inode by n, freeing it if it is no
+// longer reachable. Return EIO if the kernel forgets more lookups than it
+// made, leaving the inode alone.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) forgetInode(id fuseops.InodeID, n uint64) (err error) {
+	inode, err := fs.findInode(id)
+	if err != nil {
+		return
+	}
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	if n > inode.lookupCount {
+		log.Printf(
+			"ERROR Forgetting %d lookups of inode %v with lookup count %d",
+			n,
+			id,
+			inode.lookupCount)
+
+		err = fuse.EIO
+		return
+	}
+
+	inode.lookupCount -= n
+	fs.maybeDeallocateInode(id, inode)
+
+	return
+}
+
+// LOCKS_REQUIRED(in.mu)
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) deallocateInode(id fuseops.InodeID, in *inode) {
+	fs.releaseContents(in)
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Record the free before the ID can be reused, so that it precedes the
+	// allocation in the journal.
+	fs.record(&journalRecord{Type: recordFree, Inode: id})
 	fs.freeInodes = append(fs.freeInodes, id)
 	fs.inodes[id] = nil
+	fs.updateCounts()
+}
+
+// Drop the contents of a file, returning their space to the file system.
+//
+// LOCKS_REQUIRED(in.mu)
+func (fs *fileSystem) releaseContents(in *inode) {
+	fs.releaseBytes(in.contents.allocated())
+	in.contents = fileContents{}
+	in.attrs.Size = 0
+}
+
+// Update the access time of the inode for a read, if the atime mode calls
+// for it. Under relatime most reads don't, so check with a read lock first.
+//
+// LOCKS_EXCLUDED(in.mu)
+func (fs *fileSystem) markAccessed(id fuseops.InodeID, in *inode) {
+	// Access times are left alone on a read-only file system.
+	if fs.checkWritable() != nil {
+		return
+	}
+
+	now := time.Now()
+
+	in.mu.RLock()
+	update := in.atimeNeedsUpdate(fs.atimeMode, now)
+	in.mu.RUnlock()
+
+	if !update {
+		return
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	if in.atimeNeedsUpdate(fs.atimeMode, now) {
+		in.attrs.Atime = now
+		fs.recordAttrs(id, in)
+	}
+}
+
+// Is the directory with the given ID an ancestor of the directory with ID
+// descendant, or the same directory? Stable only while fs.renameMu is held.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) isAncestor(
+	id fuseops.InodeID,
+	descendant fuseops.InodeID) bool {
+	for descendant != 0 {
+		if descendant == id {
+			return true
+		}
+
+		in := fs.getInode(descendant)
+		if in == nil {
+			return false
+		}
+
+		descendant = in.parentID()
+	}
+
+	return false
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -204,17 +782,34 @@ func (fs *fileSystem) deallocateInode(id fuseops.InodeID) {
 func (fs *fileSystem) StatFS(
 	ctx context.Context,
 	op *fuseops.StatFSOp) (err error) {
-	// Simulate a large amount of free space so that the Finder doesn't refuse to
-	// copy in files. Use 2^17 as the block size because that is the largest that
-	// OS X will pass on.
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	// Use 2^17 as the block size because that is the largest that OS X will
+	// pass on. Without a size limit, simulate a large amount of free space so
+	// that the Finder doesn't refuse to copy in files.
 	op.BlockSize = 1 << 17 // 131072 = 128 KiB
 	op.Blocks = 1 << 33
-	op.BlocksFree = op.Blocks
-	op.BlocksAvailable = op.Blocks
+	if fs.sizeLimit != 0 {
+		op.Blocks = fs.sizeLimit / uint64(op.BlockSize)
+	}
+
+	usedBytes := atomic.LoadUint64(&fs.usedBytes)
+	usedBlocks := (usedBytes + uint64(op.BlockSize) - 1) / uint64(op.BlockSize)
+	if usedBlocks < op.Blocks {
+		op.BlocksFree = op.Blocks - usedBlocks
+	}
+	op.BlocksAvailable = op.BlocksFree
 
 	// Similarly with inodes.
 	op.Inodes = 1 << 50
-	op.InodesFree = op.Inodes - uint64(len(fs.inodes))
+	if fs.inodeLimit != 0 {
+		op.Inodes = fs.inodeLimit
+	}
+
+	if usedInodes := fs.liveInodes(); usedInodes < op.Inodes {
+		op.InodesFree = op.Inodes - usedInodes
+	}
 
 	// Prefer large transfers. This is the largest value that OS X will
 	// faithfully pass on, according to fuseops/ops.go.
@@ -226,30 +821,62 @@ func (fs *fileSystem) StatFS(
 func (fs *fileSystem) LookUpInode(
 	ctx context.Context,
 	op *fuseops.LookUpInodeOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	err = checkName(op.Name)
+	if err != nil {
+		return
+	}
 
 	// Grab the parent directory.
-	inode := fs.getInodeOrDie(op.Parent)
+	inode, err := fs.findInode(op.Parent)
+	if err != nil {
+		return
+	}
+
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
+
+	if !inode.isDir() {
+		err = fuse.ENOTDIR
+		return
+	}
 
-	// Does the directory have an entry with the given name?
+	// Searching a directory requires execute permission on it.
+	err = checkAccess(op.OpContext, inode, accessExec)
+	if err != nil {
+		return
+	}
+
+	// Does the directory have an entry with the given name? If not, a zero
+	// child ID with no error lets the kernel cache a negative entry.
 	childID, _, ok := inode.LookUpChild(op.Name)
 	if !ok {
-		err = fuse.ENOENT
+		if fs.negativeTimeout == 0 {
+			err = fuse.ENOENT
+			return
+		}
+
+		op.Entry.EntryExpiration = time.Now().Add(fs.negativeTimeout)
 		return
 	}
 
 	// Grab the child.
-	child := fs.getInodeOrDie(childID)
+	child, err := fs.findInode(childID)
+	if err != nil {
+		return
+	}
+
+	child.mu.Lock()
+	defer child.mu.Unlock()
+
+	// The kernel now holds a reference to the child.
+	child.lookupCount++
 
 	// Fill in the response.
 	op.Entry.Child = childID
 	op.Entry.Attributes = child.attrs
 
-	// We don't spontaneously mutate, so the kernel can cache as long as it wants
-	// (since it also handles invalidation).
-	op.Entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
-	op.Entry.EntryExpiration = op.Entry.EntryExpiration
+	// Let the kernel cache the entry according to the mount's policy.
+	fs.setExpiration(&op.Entry)
 
 	return
 }
@@ -257,18 +884,20 @@ func (fs *fileSystem) LookUpInode(
 func (fs *fileSystem) GetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.GetInodeAttributesOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
 	// Grab the inode.
-	inode := fs.getInodeOrDie(op.Inode)
+	inode, err := fs.findInode(op.Inode)
+	if err != nil {
+		return
+	}
+
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
 
 	// Fill in the response.
 	op.Attributes = inode.attrs
 
-	// We don't spontaneously mutate, so the kernel can cache as long as it wants
-	// (since it also handles invalidation).
-	op.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
+	// Let the kernel cache the attributes according to the mount's policy.
+	op.AttributesExpiration = time.Now().Add(fs.attrTimeout)
 
 	return
 }
@@ -276,21 +905,101 @@ func (fs *fileSystem) GetInodeAttributes(
 func (fs *fileSystem) SetInodeAttributes(
 	ctx context.Context,
 	op *fuseops.SetInodeAttributesOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	err = fs.checkWritable()
+	if err != nil {
+		return
+	}
 
 	// Grab the inode.
-	inode := fs.getInodeOrDie(op.Inode)
+	inode, err := fs.findInode(op.Inode)
+	if err != nil {
+		return
+	}
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	// Only files can be truncated.
+	if op.Size != nil {
+		switch {
+		case inode.isDir():
+			err = syscall.EISDIR
+			return
+
+		case !inode.isFile():
+			err = fuse.EINVAL
+			return
+		}
+	}
+
+	// Truncating requires write permission, unless it is done through a handle
+	// that was checked when it was opened. Changing the mode requires
+	// ownership, and setting the times requires either.
+	if op.Size != nil && op.Handle == nil {
+		err = checkAccess(op.OpContext, inode, accessWrite)
+		if err != nil {
+			return
+		}
+	}
 
-	// Handle the request.
-	inode.SetAttributes(op.Size, op.Mode, op.Mtime)
+	mode := op.Mode
+	if mode != nil {
+		err = checkOwner(op.OpContext, inode)
+		if err != nil {
+			return
+		}
+
+		// As with chmod(2), the setgid bit is silently dropped for callers
+		// other than root who aren't members of the inode's group.
+		if *mode&os.ModeSetgid != 0 &&
+			op.OpContext.Uid != 0 &&
+			!inGroup(op.OpContext, inode.attrs.Gid) {
+			cleared := *mode &^ os.ModeSetgid
+			mode = &cleared
+		}
+	}
+
+	if (op.Atime != nil || op.Mtime != nil) &&
+		checkOwner(op.OpContext, inode) != nil {
+		err = checkAccess(op.OpContext, inode, accessWrite)
+		if err != nil {
+			return
+		}
+	}
+
+	if op.Uid != nil || op.Gid != nil {
+		err = checkChown(op.OpContext, inode, op.Uid, op.Gid)
+		if err != nil {
+			return
+		}
+	}
+
+	// Handle the request. Changing the size never allocates, since extending
+	// the file leaves a hole.
+	if op.Size != nil {
+		fs.truncateContents(inode, *op.Size)
+	}
+
+	inode.SetAttributes(nil, mode, op.Atime, op.Mtime)
+
+	if op.Uid != nil || op.Gid != nil {
+		inode.SetOwner(op.Uid, op.Gid)
+	}
+
+	if op.Size != nil {
+		fs.record(&journalRecord{
+			Type:   recordTruncate,
+			Inode:  op.Inode,
+			Offset: int64(*op.Size),
+		})
+	}
+	fs.recordAttrs(op.Inode, inode)
 
 	// Fill in the response.
 	op.Attributes = inode.attrs
 
-	// We don't spontaneously mutate, so the kernel can cache as long as it wants
-	// (since it also handles invalidation).
-	op.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
+	// Let the kernel cache the attributes according to the mount's policy.
+	op.AttributesExpiration = time.Now().Add(fs.attrTimeout)
 
 	return
 }
@@ -298,18 +1007,55 @@ func (fs *fileSystem) SetInodeAttributes(
 func (fs *fileSystem) ForgetInode(
 	ctx context.Context,
 	op *fuseops.ForgetInodeOp) (err error) {
-	err = fuse.ENOSYS
+	err = fs.forgetInode(op.Inode, op.N)
+	return
+}
+
+func (fs *fileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) (err error) {
+	// Forget as much as possible, reporting the first failure.
+	for _, entry := range op.Entries {
+		if forgetErr := fs.forgetInode(entry.Inode, entry.N); err == nil {
+			err = forgetErr
+		}
+	}
+
 	return
 }
 
 func (fs *fileSystem) MkDir(
 	ctx context.Context,
 	op *fuseops.MkDirOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	err = fs.checkWritable()
+	if err != nil {
+		return
+	}
+
+	err = checkName(op.Name)
+	if err != nil {
+		return
+	}
 
 	// Grab the parent, which we will update shortly.
-	parent := fs.getInodeOrDie(op.Parent)
+	parent, err := fs.findInode(op.Parent)
+	if err != nil {
+		return
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	if !parent.isDir() {
+		err = fuse.ENOTDIR
+		return
+	}
+
+	// Changing a directory requires write and search permission on it.
+	err = checkAccess(op.OpContext, parent, accessWrite|accessExec)
+	if err != nil {
+		return
+	}
 
 	// Ensure that the name doesn't already exist, so we don't wind up with a
 	// duplicate.
@@ -320,27 +1066,35 @@ func (fs *fileSystem) MkDir(
 	}
 
 	// Set up attributes from the child.
+	uid, gid := fs.newOwner(op.OpContext)
 	childAttrs := fuseops.InodeAttributes{
-		Nlink: 1,
+		Nlink: 2,
 		Mode:  op.Mode,
-		Uid:   fs.uid,
-		Gid:   fs.gid,
+		Uid:   uid,
+		Gid:   gid,
 	}
 
 	// Allocate a child.
-	childID, child := fs.allocateInode(childAttrs)
+	childID, child, err := fs.allocateInode(childAttrs)
+	if err != nil {
+		return
+	}
+
+	child.lookupCount++
+	child.setParentID(op.Parent)
 
 	// Add an entry in the parent.
 	parent.AddChild(childID, op.Name, fuseutil.DT_Directory)
 
+	fs.recordAlloc(childID, child)
+	fs.recordAddChild(op.Parent, parent, op.Name, childID, fuseutil.DT_Directory)
+
 	// Fill in the response.
 	op.Entry.Child = childID
 	op.Entry.Attributes = child.attrs
 
-	// We don't spontaneously mutate, so the kernel can cache as long as it wants
-	// (since it also handles invalidation).
-	op.Entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
-	op.Entry.EntryExpiration = op.Entry.EntryExpiration
+	// Let the kernel cache the entry according to the mount's policy.
+	fs.setExpiration(&op.Entry)
 
 	return
 }
@@ -348,20 +1102,67 @@ func (fs *fileSystem) MkDir(
 func (fs *fileSystem) MkNode(
 	ctx context.Context,
 	op *fuseops.MkNodeOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	err = fs.checkWritable()
+	if err != nil {
+		return
+	}
+
+	// Only files, FIFOs, sockets and devices can be made this way.
+	switch direntTypeForMode(op.Mode) {
+	case fuseutil.DT_File, fuseutil.DT_FIFO, fuseutil.DT_Socket:
+		op.Rdev = 0
+
+	case fuseutil.DT_Block, fuseutil.DT_Char:
+		// The kernel has already checked that the caller may make device
+		// nodes. On a nodev mount they can be made but not opened, which the
+		// kernel enforces too.
+
+	default:
+		err = syscall.EINVAL
+		return
+	}
+
+	op.Entry, err = fs.createFile(
+		op.OpContext,
+		op.Parent,
+		op.Name,
+		op.Mode,
+		op.Rdev)
 
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
 	return
 }
 
-// LOCKS_REQUIRED(fs.mu)
+// LOCKS_EXCLUDED(fs.mu)
 func (fs *fileSystem) createFile(
+	opCtx fuseops.OpContext,
 	parentID fuseops.InodeID,
 	name string,
-	mode os.FileMode) (entry fuseops.ChildInodeEntry, err error) {
+	mode os.FileMode,
+	rdev uint32) (entry fuseops.ChildInodeEntry, err error) {
+	err = checkName(name)
+	if err != nil {
+		return
+	}
+
 	// Grab the parent, which we will update shortly.
-	parent := fs.getInodeOrDie(parentID)
+	parent, err := fs.findInode(parentID)
+	if err != nil {
+		return
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	if !parent.isDir() {
+		err = fuse.ENOTDIR
+		return
+	}
+
+	// Changing a directory requires write and search permission on it.
+	err = checkAccess(opCtx, parent, accessWrite|accessExec)
+	if err != nil {
+		return
+	}
 
 	// Ensure that the name doesn't already exist, so we don't wind up with a
 	// duplicate.
@@ -372,32 +1173,41 @@ func (fs *fileSystem) createFile(
 	}
 
 	// Set up attributes for the child.
+	uid, gid := fs.newOwner(opCtx)
 	now := time.Now()
 	childAttrs := fuseops.InodeAttributes{
 		Nlink:  1,
 		Mode:   mode,
+		Rdev:   rdev,
 		Atime:  now,
 		Mtime:  now,
 		Ctime:  now,
 		Crtime: now,
-		Uid:    fs.uid,
-		Gid:    fs.gid,
+		Uid:    uid,
+		Gid:    gid,
 	}
 
 	// Allocate a child.
-	childID, child := fs.allocateInode(childAttrs)
+	childID, child, err := fs.allocateInode(childAttrs)
+	if err != nil {
+		return
+	}
+
+	child.lookupCount++
 
 	// Add an entry in the parent.
-	parent.AddChild(childID, name, fuseutil.DT_File)
+	dt := child.direntType()
+	parent.AddChild(childID, name, dt)
+
+	fs.recordAlloc(childID, child)
+	fs.recordAddChild(parentID, parent, name, childID, dt)
 
 	// Fill in the response entry.
 	entry.Child = childID
 	entry.Attributes = child.attrs
 
-	// We don't spontaneously mutate, so the kernel can cache as long as it wants
-	// (since it also handles invalidation).
-	entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
-	entry.EntryExpiration = entry.AttributesExpiration
+	// Let the kernel cache the entry according to the mount's policy.
+	fs.setExpiration(&entry)
 
 	return
 }
@@ -405,10 +1215,26 @@ func (fs *fileSystem) createFile(
 func (fs *fileSystem) CreateFile(
 	ctx context.Context,
 	op *fuseops.CreateFileOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	err = fs.checkWritable()
+	if err != nil {
+		return
+	}
+
+	op.Entry, err = fs.createFile(op.OpContext, op.Parent, op.Name, op.Mode, 0)
+	if err != nil {
+		return
+	}
+
+	// Open the new file for reading and writing.
+	child, err := fs.findInode(op.Entry.Child)
+	if err != nil {
+		return
+	}
 
-	op.Entry, err = fs.createFile(op.Parent, op.Name, op.Mode)
+	child.mu.Lock()
+	defer child.mu.Unlock()
+
+	op.Handle = fs.openFile(op.Entry.Child, child, syscall.O_RDWR)
 
 	return
 }
@@ -416,11 +1242,35 @@ func (fs *fileSystem) CreateFile(
 func (fs *fileSystem) CreateSymlink(
 	ctx context.Context,
 	op *fuseops.CreateSymlinkOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	err = fs.checkWritable()
+	if err != nil {
+		return
+	}
+
+	err = checkName(op.Name)
+	if err != nil {
+		return
+	}
 
 	// Grab the parent, which we will update shortly.
-	parent := fs.getInodeOrDie(op.Parent)
+	parent, err := fs.findInode(op.Parent)
+	if err != nil {
+		return
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	if !parent.isDir() {
+		err = fuse.ENOTDIR
+		return
+	}
+
+	// Changing a directory requires write and search permission on it.
+	err = checkAccess(op.OpContext, parent, accessWrite|accessExec)
+	if err != nil {
+		return
+	}
 
 	// Ensure that the name doesn't already exist, so we don't wind up with a
 	// duplicate.
@@ -431,6 +1281,7 @@ func (fs *fileSystem) CreateSymlink(
 	}
 
 	// Set up attributes from the child.
+	uid, gid := fs.newOwner(op.OpContext)
 	now := time.Now()
 	childAttrs := fuseops.InodeAttributes{
 		Nlink:  1,
@@ -439,12 +1290,17 @@ func (fs *fileSystem) CreateSymlink(
 		Mtime:  now,
 		Ctime:  now,
 		Crtime: now,
-		Uid:    fs.uid,
-		Gid:    fs.gid,
+		Uid:    uid,
+		Gid:    gid,
 	}
 
 	// Allocate a child.
-	childID, child := fs.allocateInode(childAttrs)
+	childID, child, err := fs.allocateInode(childAttrs)
+	if err != nil {
+		return
+	}
+
+	child.lookupCount++
 
 	// Set up its target.
 	child.target = op.Target
@@ -452,14 +1308,15 @@ func (fs *fileSystem) CreateSymlink(
 	// Add an entry in the parent.
 	parent.AddChild(childID, op.Name, fuseutil.DT_Link)
 
+	fs.recordAlloc(childID, child)
+	fs.recordAddChild(op.Parent, parent, op.Name, childID, fuseutil.DT_Link)
+
 	// Fill in the response entry.
 	op.Entry.Child = childID
 	op.Entry.Attributes = child.attrs
 
-	// We don't spontaneously mutate, so the kernel can cache as long as it wants
-	// (since it also handles invalidation).
-	op.Entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
-	op.Entry.EntryExpiration = op.Entry.EntryExpiration
+	// Let the kernel cache the entry according to the mount's policy.
+	fs.setExpiration(&op.Entry)
 
 	return
 }
@@ -467,11 +1324,52 @@ func (fs *fileSystem) CreateSymlink(
 func (fs *fileSystem) CreateLink(
 	ctx context.Context,
 	op *fuseops.CreateLinkOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	err = fs.checkWritable()
+	if err != nil {
+		return
+	}
+
+	err = checkName(op.Name)
+	if err != nil {
+		return
+	}
+
+	// Get the target inode to be linked. Directories can't be hard linked.
+	// Check that before locking the parent, which a directory could be an
+	// ancestor of. The type of an inode never changes.
+	target, err := fs.findInode(op.Target)
+	if err != nil {
+		return
+	}
+
+	target.mu.RLock()
+	targetIsDir := target.isDir()
+	target.mu.RUnlock()
+
+	if targetIsDir {
+		err = syscall.EPERM
+		return
+	}
 
 	// Grab the parent, which we will update shortly.
-	parent := fs.getInodeOrDie(op.Parent)
+	parent, err := fs.findInode(op.Parent)
+	if err != nil {
+		return
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	if !parent.isDir() {
+		err = fuse.ENOTDIR
+		return
+	}
+
+	// Changing a directory requires write and search permission on it.
+	err = checkAccess(op.OpContext, parent, accessWrite|accessExec)
+	if err != nil {
+		return
+	}
 
 	// Ensure that the name doesn't already exist, so we don't wind up with a
 	// duplicate.
@@ -481,58 +1379,213 @@ func (fs *fileSystem) CreateLink(
 		return
 	}
 
-	// Get the target inode to be linked
-	target := fs.getInodeOrDie(op.Target)
-
-	// Update the attributes
-	now := time.Now()
-	target.attrs.Nlink++
-	target.attrs.Ctime = now
+	target.mu.Lock()
+	defer target.mu.Unlock()
+
+	// A file that has been unlinked for good can't be linked again.
+	if target.attrs.Nlink == 0 {
+		err = fuse.ENOENT
+		return
+	}
+
+	// Update the attributes
+	now := time.Now()
+	target.attrs.Nlink++
+	target.attrs.Ctime = now
+	target.lookupCount++
+
+	// Add an entry in the parent.
+	dt := target.direntType()
+	parent.AddChild(op.Target, op.Name, dt)
+
+	fs.recordAttrs(op.Target, target)
+	fs.recordAddChild(op.Parent, parent, op.Name, op.Target, dt)
+
+	// Return the response.
+	op.Entry.Child = op.Target
+	op.Entry.Attributes = target.attrs
+
+	// Let the kernel cache the entry according to the mount's policy.
+	fs.setExpiration(&op.Entry)
+
+	return
+}
+
+func (fs *fileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	err = fs.checkWritable()
+	if err != nil {
+		return
+	}
+
+	err = checkName(op.NewName)
+	if err != nil {
+		return
+	}
+
+	oldParent, err := fs.findInode(op.OldParent)
+	if err != nil {
+		return
+	}
+	newParent, err := fs.findInode(op.NewParent)
+	if err != nil {
+		return
+	}
+
+	// Lock the parents. Moving between directories changes the shape of the
+	// tree, so it is serialized, and the parents are locked ancestor first.
+	if op.OldParent == op.NewParent {
+		oldParent.mu.Lock()
+		defer oldParent.mu.Unlock()
+	} else {
+		fs.renameMu.Lock()
+		defer fs.renameMu.Unlock()
+
+		first, second := oldParent, newParent
+		switch {
+		case fs.isAncestor(op.OldParent, op.NewParent):
+		case fs.isAncestor(op.NewParent, op.OldParent):
+			first, second = newParent, oldParent
+		case op.NewParent < op.OldParent:
+			first, second = newParent, oldParent
+		}
+
+		first.mu.Lock()
+		defer first.mu.Unlock()
+
+		second.mu.Lock()
+		defer second.mu.Unlock()
+	}
+
+	if !oldParent.isDir() || !newParent.isDir() {
+		err = fuse.ENOTDIR
+		return
+	}
+
+	// Changing the directories requires write and search permission on both.
+	err = checkAccess(op.OpContext, oldParent, accessWrite|accessExec)
+	if err != nil {
+		return
+	}
+
+	err = checkAccess(op.OpContext, newParent, accessWrite|accessExec)
+	if err != nil {
+		return
+	}
+
+	// Ask the old parent for the child's inode ID and type.
+	childID, childType, ok := oldParent.LookUpChild(op.OldName)
+
+	if !ok {
+		err = fuse.ENOENT
+		return
+	}
+
+	// A directory can't be moved into itself.
+	if childType == fuseutil.DT_Directory &&
+		op.OldParent != op.NewParent &&
+		fs.isAncestor(childID, op.NewParent) {
+		err = fuse.EINVAL
+		return
+	}
+
+	// See whether the new name exists already in the new parent.
+	existingID, _, replace := newParent.LookUpChild(op.NewName)
+	if replace && existingID == childID {
+		// Both names refer to the same inode, so there is nothing to do.
+		return
+	}
+
+	// If the new name is an ancestor of the old parent, it is certainly not
+	// empty, and can't be moved into itself either.
+	if replace &&
+		op.OldParent != op.NewParent &&
+		fs.isAncestor(existingID, op.OldParent) {
+		err = fuse.ENOTEMPTY
+		return
+	}
+
+	// Lock the child and whatever it replaces, in order of inode ID.
+	child, err := fs.findInode(childID)
+	if err != nil {
+		return
+	}
 
-	// Add an entry in the parent.
-	parent.AddChild(op.Target, op.Name, fuseutil.DT_File)
+	var existing *inode
+	if replace {
+		existing, err = fs.findInode(existingID)
+		if err != nil {
+			return
+		}
+	}
 
-	// Return the response.
-	op.Entry.Child = op.Target
-	op.Entry.Attributes = target.attrs
+	if replace && existingID < childID {
+		existing.mu.Lock()
+		defer existing.mu.Unlock()
+	}
 
-	// We don't spontaneously mutate, so the kernel can cache as long as it wants
-	// (since it also handles invalidation).
-	op.Entry.AttributesExpiration = time.Now().Add(365 * 24 * time.Hour)
-	op.Entry.EntryExpiration = op.Entry.EntryExpiration
+	child.mu.Lock()
+	defer child.mu.Unlock()
 
-	return
-}
+	if replace && existingID > childID {
+		existing.mu.Lock()
+		defer existing.mu.Unlock()
+	}
 
-func (fs *fileSystem) Rename(
-	ctx context.Context,
-	op *fuseops.RenameOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	// Sticky directories protect both the child and whatever it replaces.
+	err = checkSticky(op.OpContext, oldParent, child)
+	if err != nil {
+		return
+	}
 
-	// Ask the old parent for the child's inode ID and type.
-	oldParent := fs.getInodeOrDie(op.OldParent)
-	childID, childType, ok := oldParent.LookUpChild(op.OldName)
+	if replace {
+		err = checkSticky(op.OpContext, newParent, existing)
+		if err != nil {
+			return
+		}
+	}
 
-	if !ok {
-		err = fuse.ENOENT
-		return
+	// Moving a directory to a new parent rewrites its "..", which requires
+	// write permission on it.
+	if op.OldParent != op.NewParent && child.isDir() {
+		err = checkAccess(op.OpContext, child, accessWrite)
+		if err != nil {
+			return
+		}
 	}
 
-	// If the new name exists already in the new parent, make sure it's not a
-	// non-empty directory, then delete it.
-	newParent := fs.getInodeOrDie(op.NewParent)
-	existingID, _, ok := newParent.LookUpChild(op.NewName)
-	if ok {
-		existing := fs.getInodeOrDie(existingID)
+	now := time.Now()
+
+	// If the new name exists already, make sure it can be replaced by the
+	// child, then unlink it.
+	if replace {
+		switch {
+		case child.isDir() && !existing.isDir():
+			err = fuse.ENOTDIR
+			return
+
+		case !child.isDir() && existing.isDir():
+			err = syscall.EISDIR
+			return
 
-		var buf [4096]byte
-		if existing.isDir() && existing.ReadDir(buf[:], 0) > 0 {
+		case existing.isDir() && existing.Len() != 0:
 			err = fuse.ENOTEMPTY
 			return
 		}
 
 		newParent.RemoveChild(op.NewName)
+
+		// A replaced directory loses its "." link along with its entry.
+		existing.attrs.Nlink--
+		existing.attrs.Ctime = now
+		if existing.isDir() {
+			existing.attrs.Nlink = 0
+			existing.setParentID(0)
+		}
+
+		fs.recordRemoveChild(op.NewParent, newParent, op.NewName)
+		fs.recordAttrs(existingID, existing)
 	}
 
 	// Link the new name.
@@ -541,30 +1594,81 @@ func (fs *fileSystem) Rename(
 		op.NewName,
 		childType)
 
+	if child.isDir() {
+		child.setParentID(op.NewParent)
+	}
+
+	// Renaming changes the child, even if not its contents.
+	child.attrs.Ctime = now
+
 	// Finally, remove the old name from the old parent.
 	oldParent.RemoveChild(op.OldName)
 
+	fs.recordAddChild(op.NewParent, newParent, op.NewName, childID, childType)
+	fs.recordRemoveChild(op.OldParent, oldParent, op.OldName)
+	fs.recordAttrs(childID, child)
+
+	// The replaced inode may now be gone for good.
+	if replace {
+		fs.maybeDeallocateInode(existingID, existing)
+	}
+
 	return
 }
 
 func (fs *fileSystem) RmDir(
 	ctx context.Context,
 	op *fuseops.RmDirOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	err = fs.checkWritable()
+	if err != nil {
+		return
+	}
 
 	// Grab the parent, which we will update shortly.
-	parent := fs.getInodeOrDie(op.Parent)
+	parent, err := fs.findInode(op.Parent)
+	if err != nil {
+		return
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
 
-	// Find the child within the parent.
-	childID, _, ok := parent.LookUpChild(op.Name)
+	if !parent.isDir() {
+		err = fuse.ENOTDIR
+		return
+	}
+
+	// Changing a directory requires write and search permission on it.
+	err = checkAccess(op.OpContext, parent, accessWrite|accessExec)
+	if err != nil {
+		return
+	}
+
+	// Find the child within the parent, which must be a directory.
+	childID, childType, ok := parent.LookUpChild(op.Name)
 	if !ok {
 		err = fuse.ENOENT
 		return
 	}
 
+	if childType != fuseutil.DT_Directory {
+		err = fuse.ENOTDIR
+		return
+	}
+
 	// Grab the child.
-	child := fs.getInodeOrDie(childID)
+	child, err := fs.findInode(childID)
+	if err != nil {
+		return
+	}
+
+	child.mu.Lock()
+	defer child.mu.Unlock()
+
+	err = checkSticky(op.OpContext, parent, child)
+	if err != nil {
+		return
+	}
 
 	// Make sure the child is empty.
 	if child.Len() != 0 {
@@ -575,8 +1679,14 @@ func (fs *fileSystem) RmDir(
 	// Remove the entry within the parent.
 	parent.RemoveChild(op.Name)
 
-	// Mark the child as unlinked.
-	child.attrs.Nlink--
+	// Mark the child as unlinked. Its "." link goes with it.
+	child.attrs.Nlink = 0
+	child.attrs.Ctime = time.Now()
+	child.setParentID(0)
+
+	fs.recordRemoveChild(op.Parent, parent, op.Name)
+	fs.recordAttrs(childID, child)
+	fs.maybeDeallocateInode(childID, child)
 
 	return
 }
@@ -584,27 +1694,68 @@ func (fs *fileSystem) RmDir(
 func (fs *fileSystem) Unlink(
 	ctx context.Context,
 	op *fuseops.UnlinkOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	err = fs.checkWritable()
+	if err != nil {
+		return
+	}
 
 	// Grab the parent, which we will update shortly.
-	parent := fs.getInodeOrDie(op.Parent)
+	parent, err := fs.findInode(op.Parent)
+	if err != nil {
+		return
+	}
 
-	// Find the child within the parent.
-	childID, _, ok := parent.LookUpChild(op.Name)
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	if !parent.isDir() {
+		err = fuse.ENOTDIR
+		return
+	}
+
+	// Changing a directory requires write and search permission on it.
+	err = checkAccess(op.OpContext, parent, accessWrite|accessExec)
+	if err != nil {
+		return
+	}
+
+	// Find the child within the parent. Directories must be removed with
+	// RmDir instead.
+	childID, childType, ok := parent.LookUpChild(op.Name)
 	if !ok {
 		err = fuse.ENOENT
 		return
 	}
 
+	if childType == fuseutil.DT_Directory {
+		err = syscall.EISDIR
+		return
+	}
+
 	// Grab the child.
-	child := fs.getInodeOrDie(childID)
+	child, err := fs.findInode(childID)
+	if err != nil {
+		return
+	}
+
+	child.mu.Lock()
+	defer child.mu.Unlock()
+
+	err = checkSticky(op.OpContext, parent, child)
+	if err != nil {
+		return
+	}
 
 	// Remove the entry within the parent.
 	parent.RemoveChild(op.Name)
 
 	// Mark the child as unlinked.
 	child.attrs.Nlink--
+	child.attrs.Ctime = time.Now()
+
+	fs.recordRemoveChild(op.Parent, parent, op.Name)
+	fs.recordAttrs(childID, child)
+	fs.maybeDeallocateInode(childID, child)
 
 	return
 }
@@ -612,32 +1763,52 @@ func (fs *fileSystem) Unlink(
 func (fs *fileSystem) OpenDir(
 	ctx context.Context,
 	op *fuseops.OpenDirOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
 	// We don't mutate spontaneously, so if the VFS layer has asked for an
 	// inode that doesn't exist, something screwed up earlier (a lookup, a
 	// cache invalidation, etc.).
-	inode := fs.getInodeOrDie(op.Inode)
+	inode, err := fs.findInode(op.Inode)
+	if err != nil {
+		return
+	}
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
 
 	if !inode.isDir() {
-		panic("Found non-dir.")
+		err = fuse.ENOTDIR
+		return
 	}
 
+	// Listing a directory requires read permission on it.
+	err = checkAccess(op.OpContext, inode, accessRead)
+	if err != nil {
+		return
+	}
+
+	op.Handle = fs.openDir(op.Inode, inode)
+
 	return
 }
 
 func (fs *fileSystem) ReadDir(
 	ctx context.Context,
 	op *fuseops.ReadDirOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
 	// Grab the directory.
-	inode := fs.getInodeOrDie(op.Inode)
+	h, err := fs.getDirHandle(op.Handle)
+	if err != nil {
+		return
+	}
+
+	inode := h.in
+
+	// Update the access time once we're done.
+	defer fs.markAccessed(h.id, inode)
+
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
 
 	// Serve the request.
-	op.BytesRead = inode.ReadDir(op.Dst, int(op.Offset))
+	op.BytesRead = inode.ReadDir(h.id, op.Dst, op.Offset)
 
 	return
 }
@@ -645,39 +1816,82 @@ func (fs *fileSystem) ReadDir(
 func (fs *fileSystem) ReleaseDirHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseDirHandleOp) (err error) {
-	err = fuse.ENOSYS
+	err = fs.releaseHandle(op.Handle, true)
 	return
 }
 
 func (fs *fileSystem) OpenFile(
 	ctx context.Context,
 	op *fuseops.OpenFileOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
 	// We don't mutate spontaneosuly, so if the VFS layer has asked for an
 	// inode that doesn't exist, something screwed up earlier (a lookup, a
 	// cache invalidation, etc.).
-	inode := fs.getInodeOrDie(op.Inode)
+	inode, err := fs.findInode(op.Inode)
+	if err != nil {
+		return
+	}
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	// The kernel opens other kinds of inode itself, without asking us.
+	switch {
+	case inode.isDir():
+		err = syscall.EISDIR
+		return
+
+	case !inode.isFile():
+		err = fuse.EIO
+		return
+	}
+
+	err = checkAccess(op.OpContext, inode, accessForFlags(op.OpenFlags))
+	if err != nil {
+		return
+	}
 
-	if !inode.isFile() {
-		panic("Found non-file.")
+	if accessForFlags(op.OpenFlags)&accessWrite != 0 {
+		err = fs.checkWritable()
+		if err != nil {
+			return
+		}
 	}
 
+	op.Handle = fs.openFile(op.Inode, inode, op.OpenFlags)
+
 	return
 }
 
 func (fs *fileSystem) ReadFile(
 	ctx context.Context,
 	op *fuseops.ReadFileOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	// Find the inode in question. It may have been unlinked since it was
+	// opened.
+	h, err := fs.getFileHandle(op.Handle)
+	if err != nil {
+		return
+	}
 
-	// Find the inode in question.
-	inode := fs.getInodeOrDie(op.Inode)
+	if !h.readable() {
+		err = syscall.EBADF
+		return
+	}
 
-	// Serve the request.
-	op.BytesRead, err = inode.ReadAt(op.Dst, op.Offset)
+	inode := h.in
+
+	// Update the access time once we're done.
+	defer fs.markAccessed(h.id, inode)
+
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
+
+	// Serve the request. For vectored reads there is no destination buffer,
+	// and we reply with the pages themselves instead of copying them.
+	if op.Dst == nil {
+		op.Data, op.BytesRead, err = inode.ReadSlices(int(op.Size), op.Offset)
+	} else {
+		op.BytesRead, err = inode.ReadAt(op.Dst, op.Offset)
+	}
 
 	// Don't return EOF errors; we just indicate EOF to fuse using a short read.
 	if err == io.EOF {
@@ -690,14 +1904,140 @@ func (fs *fileSystem) ReadFile(
 func (fs *fileSystem) WriteFile(
 	ctx context.Context,
 	op *fuseops.WriteFileOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	err = fs.checkWritable()
+	if err != nil {
+		return
+	}
 
-	// Find the inode in question.
-	inode := fs.getInodeOrDie(op.Inode)
+	// Find the inode in question. It may have been unlinked since it was
+	// opened.
+	h, err := fs.getFileHandle(op.Handle)
+	if err != nil {
+		return
+	}
 
-	// Serve the request.
-	_, err = inode.WriteAt(op.Data, op.Offset)
+	if !h.writable() {
+		err = syscall.EBADF
+		return
+	}
+
+	inode := h.in
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	// Writes to a file opened for appending always go to the end.
+	offset := op.Offset
+	if h.appending() {
+		offset = int64(inode.attrs.Size)
+	}
+
+	// Serve the request, making sure any new pages fit within the size limit.
+	err = fs.writeContents(inode, op.Data, offset)
+	if err != nil {
+		return
+	}
+
+	fs.record(&journalRecord{
+		Type:   recordWrite,
+		Inode:  h.id,
+		Offset: offset,
+		Data:   op.Data,
+	})
+	fs.recordAttrs(h.id, inode)
+
+	return
+}
+
+func (fs *fileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) (err error) {
+	err = fs.checkWritable()
+	if err != nil {
+		return
+	}
+
+	// Find the inode in question. Like writing, this requires a handle open for
+	// writing.
+	h, err := fs.getFileHandle(op.Handle)
+	if err != nil {
+		return
+	}
+
+	if !h.writable() {
+		err = syscall.EBADF
+		return
+	}
+
+	// Plain preallocation and zeroing may extend the file unless asked to keep
+	// its size. Punching a hole never does, and must say so.
+	keepSize := op.Mode&unix.FALLOC_FL_KEEP_SIZE != 0
+
+	var typ journalRecordType
+	switch op.Mode &^ unix.FALLOC_FL_KEEP_SIZE {
+	case 0:
+		typ = recordAllocate
+
+	case unix.FALLOC_FL_ZERO_RANGE:
+		typ = recordZeroRange
+
+	case unix.FALLOC_FL_PUNCH_HOLE:
+		if !keepSize {
+			err = syscall.EOPNOTSUPP
+			return
+		}
+
+		typ = recordPunchHole
+
+	default:
+		err = syscall.EOPNOTSUPP
+		return
+	}
+
+	off, n := int64(op.Offset), int64(op.Length)
+	if off < 0 || n <= 0 {
+		err = syscall.EINVAL
+		return
+	}
+
+	if off > math.MaxInt64-n {
+		err = syscall.EFBIG
+		return
+	}
+
+	inode := h.in
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
+
+	// Serve the request, making sure any new pages fit within the size limit.
+	if typ == recordPunchHole {
+		fs.punchContents(inode, off, n)
+	} else {
+		err = fs.allocateContents(inode, off, n, typ == recordZeroRange)
+		if err != nil {
+			return
+		}
+	}
+
+	fs.record(&journalRecord{
+		Type:   typ,
+		Inode:  h.id,
+		Offset: off,
+		Length: n,
+	})
+
+	if end := uint64(off + n); !keepSize && end > inode.attrs.Size {
+		fs.truncateContents(inode, end)
+		fs.record(&journalRecord{
+			Type:   recordTruncate,
+			Inode:  h.id,
+			Offset: int64(end),
+		})
+	}
+
+	inode.touch()
+	fs.recordAttrs(h.id, inode)
 
 	return
 }
@@ -705,32 +2045,83 @@ func (fs *fileSystem) WriteFile(
 func (fs *fileSystem) SyncFile(
 	ctx context.Context,
 	op *fuseops.SyncFileOp) (err error) {
-	err = fuse.ENOSYS
+	// With writeback caching the kernel writes back its dirty pages before
+	// asking us to sync, so everything we have is everything there is.
+	err = fs.syncJournal()
 	return
 }
 
 func (fs *fileSystem) FlushFile(
 	ctx context.Context,
 	op *fuseops.FlushFileOp) (err error) {
-	err = fuse.ENOSYS
+	// Flushing happens on every close of a file descriptor referring to the
+	// handle, after the kernel has written back its dirty pages.
+	_, err = fs.getFileHandle(op.Handle)
+	if err != nil {
+		return
+	}
+
+	err = fs.syncJournal()
+	return
+}
+
+// Make every change so far durable, if journaling is on.
+func (fs *fileSystem) syncJournal() (err error) {
+	if fs.journal == nil {
+		return
+	}
+
+	// The journal has its own lock, so other ops can proceed while we wait for
+	// the disk.
+	if fs.journal.sync() != nil {
+		err = fuse.EIO
+	}
+
 	return
 }
 
 func (fs *fileSystem) ReleaseFileHandle(
 	ctx context.Context,
 	op *fuseops.ReleaseFileHandleOp) (err error) {
-	err = fuse.ENOSYS
+	h, err := fs.getFileHandle(op.Handle)
+	if err != nil {
+		return
+	}
+
+	// With writeback caching, pages dirtied through a shared mapping may be
+	// written back after the last flush, but always before the release. Make
+	// them as durable as the flush made everything else. The kernel forgets
+	// the handle either way, so release it even if that fails.
+	if fs.writebackCache && h.writable() {
+		err = fs.syncJournal()
+	}
+
+	if releaseErr := fs.releaseHandle(op.Handle, false); err == nil {
+		err = releaseErr
+	}
+
 	return
 }
 
 func (fs *fileSystem) ReadSymlink(
 	ctx context.Context,
 	op *fuseops.ReadSymlinkOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
 	// Find the inode in question.
-	inode := fs.getInodeOrDie(op.Inode)
+	inode, err := fs.findInode(op.Inode)
+	if err != nil {
+		return
+	}
+
+	// Update the access time once we're done.
+	defer fs.markAccessed(op.Inode, inode)
+
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
+
+	if !inode.isSymlink() {
+		err = fuse.EINVAL
+		return
+	}
 
 	// Serve the request.
 	op.Target = inode.target
@@ -741,12 +2132,28 @@ func (fs *fileSystem) ReadSymlink(
 func (fs *fileSystem) RemoveXattr(
 	ctx context.Context,
 	op *fuseops.RemoveXattrOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-	inode := fs.getInodeOrDie(op.Inode)
+	err = fs.checkWritable()
+	if err != nil {
+		return
+	}
+
+	inode, err := fs.findInode(op.Inode)
+	if err != nil {
+		return
+	}
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
 
 	if _, ok := inode.xattrs[op.Name]; ok {
 		delete(inode.xattrs, op.Name)
+		inode.attrs.Ctime = time.Now()
+		fs.record(&journalRecord{
+			Type:  recordRemoveXattr,
+			Inode: op.Inode,
+			Name:  op.Name,
+		})
+		fs.recordAttrs(op.Inode, inode)
 	} else {
 		err = fuse.ENOATTR
 	}
@@ -757,10 +2164,14 @@ func (fs *fileSystem) RemoveXattr(
 func (fs *fileSystem) GetXattr(
 	ctx context.Context,
 	op *fuseops.GetXattrOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	inode, err := fs.findInode(op.Inode)
+	if err != nil {
+		return
+	}
+
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
 
-	inode := fs.getInodeOrDie(op.Inode)
 	if value, ok := inode.xattrs[op.Name]; ok {
 		op.BytesRead = len(value)
 		if len(op.Dst) >= len(value) {
@@ -778,10 +2189,13 @@ func (fs *fileSystem) GetXattr(
 func (fs *fileSystem) ListXattr(
 	ctx context.Context,
 	op *fuseops.ListXattrOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	inode, err := fs.findInode(op.Inode)
+	if err != nil {
+		return
+	}
 
-	inode := fs.getInodeOrDie(op.Inode)
+	inode.mu.RLock()
+	defer inode.mu.RUnlock()
 
 	dst := op.Dst[:]
 	for key := range inode.xattrs {
@@ -802,9 +2216,18 @@ func (fs *fileSystem) ListXattr(
 func (fs *fileSystem) SetXattr(
 	ctx context.Context,
 	op *fuseops.SetXattrOp) (err error) {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-	inode := fs.getInodeOrDie(op.Inode)
+	err = fs.checkWritable()
+	if err != nil {
+		return
+	}
+
+	inode, err := fs.findInode(op.Inode)
+	if err != nil {
+		return
+	}
+
+	inode.mu.Lock()
+	defer inode.mu.Unlock()
 
 	_, ok := inode.xattrs[op.Name]
 
@@ -823,6 +2246,14 @@ func (fs *fileSystem) SetXattr(
 		value := make([]byte, len(op.Value))
 		copy(value, op.Value)
 		inode.xattrs[op.Name] = value
+		inode.attrs.Ctime = time.Now()
+		fs.record(&journalRecord{
+			Type:  recordSetXattr,
+			Inode: op.Inode,
+			Name:  op.Name,
+			Data:  value,
+		})
+		fs.recordAttrs(op.Inode, inode)
 	}
 
 	return
@@ -0,0 +1,2587 @@
+package filesystem
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+	"golang.org/x/sys/unix"
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type FileSystemTest struct {
+	ctx context.Context
+	fs  *fileSystem
+}
+
+var _ = Suite(&FileSystemTest{})
+
+func (t *FileSystemTest) SetUpTest(c *C) {
+	t.ctx = context.Background()
+
+	server, err := NewServer(&ServerConfig{
+		FilePerms: 0644,
+		DirPerms:  0755,
+	})
+	c.Assert(err, IsNil)
+
+	t.fs = server.fs
+}
+
+////////////////////////////////////////////////////////////////////////
+// Helpers
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) mkDir(
+	c *C,
+	parent fuseops.InodeID,
+	name string) fuseops.InodeID {
+	op := &fuseops.MkDirOp{
+		Parent: parent,
+		Name:   name,
+		Mode:   os.ModeDir | 0755,
+	}
+
+	c.Assert(t.fs.MkDir(t.ctx, op), IsNil)
+	return op.Entry.Child
+}
+
+func (t *FileSystemTest) mkFile(
+	c *C,
+	parent fuseops.InodeID,
+	name string) fuseops.InodeID {
+	op := &fuseops.MkNodeOp{
+		Parent: parent,
+		Name:   name,
+		Mode:   0644,
+	}
+
+	c.Assert(t.fs.MkNode(t.ctx, op), IsNil)
+	return op.Entry.Child
+}
+
+func (t *FileSystemTest) mkSymlink(
+	c *C,
+	parent fuseops.InodeID,
+	name string) fuseops.InodeID {
+	op := &fuseops.CreateSymlinkOp{
+		Parent: parent,
+		Name:   name,
+		Target: "target",
+	}
+
+	c.Assert(t.fs.CreateSymlink(t.ctx, op), IsNil)
+	return op.Entry.Child
+}
+
+func (t *FileSystemTest) lookUp(
+	c *C,
+	parent fuseops.InodeID,
+	name string) fuseops.InodeID {
+	op := &fuseops.LookUpInodeOp{
+		Parent: parent,
+		Name:   name,
+	}
+
+	c.Assert(t.fs.LookUpInode(t.ctx, op), IsNil)
+	return op.Entry.Child
+}
+
+func (t *FileSystemTest) openFile(
+	c *C,
+	inode fuseops.InodeID,
+	flags fuseops.OpenFlags) fuseops.HandleID {
+	op := &fuseops.OpenFileOp{
+		Inode:     inode,
+		OpenFlags: flags,
+	}
+
+	c.Assert(t.fs.OpenFile(t.ctx, op), IsNil)
+	return op.Handle
+}
+
+func (t *FileSystemTest) write(
+	c *C,
+	handle fuseops.HandleID,
+	offset int64,
+	data string) {
+	err := t.fs.WriteFile(t.ctx, &fuseops.WriteFileOp{
+		Handle: handle,
+		Offset: offset,
+		Data:   []byte(data),
+	})
+
+	c.Assert(err, IsNil)
+}
+
+func (t *FileSystemTest) read(
+	c *C,
+	handle fuseops.HandleID,
+	offset int64,
+	size int) string {
+	op := &fuseops.ReadFileOp{
+		Handle: handle,
+		Offset: offset,
+		Dst:    make([]byte, size),
+	}
+
+	c.Assert(t.fs.ReadFile(t.ctx, op), IsNil)
+	return string(op.Dst[:op.BytesRead])
+}
+
+func (t *FileSystemTest) truncate(c *C, inode fuseops.InodeID, size uint64) {
+	err := t.fs.SetInodeAttributes(t.ctx, &fuseops.SetInodeAttributesOp{
+		Inode: inode,
+		Size:  &size,
+	})
+
+	c.Assert(err, IsNil)
+}
+
+func (t *FileSystemTest) fallocate(
+	handle fuseops.HandleID,
+	mode uint32,
+	offset uint64,
+	length uint64) error {
+	return t.fs.Fallocate(t.ctx, &fuseops.FallocateOp{
+		Handle: handle,
+		Mode:   mode,
+		Offset: offset,
+		Length: length,
+	})
+}
+
+func (t *FileSystemTest) rename(
+	oldParent fuseops.InodeID,
+	oldName string,
+	newParent fuseops.InodeID,
+	newName string) error {
+	return t.fs.Rename(t.ctx, &fuseops.RenameOp{
+		OldParent: oldParent,
+		OldName:   oldName,
+		NewParent: newParent,
+		NewName:   newName,
+	})
+}
+
+// Open the directory and read it from the given offset, returning the number
+// of bytes of entries read.
+func (t *FileSystemTest) readDir(
+	c *C,
+	inode fuseops.InodeID,
+	offset fuseops.DirOffset) int {
+	open := &fuseops.OpenDirOp{Inode: inode}
+	c.Assert(t.fs.OpenDir(t.ctx, open), IsNil)
+
+	op := &fuseops.ReadDirOp{
+		Inode:  inode,
+		Handle: open.Handle,
+		Offset: offset,
+		Dst:    make([]byte, 4096),
+	}
+
+	c.Assert(t.fs.ReadDir(t.ctx, op), IsNil)
+	return op.BytesRead
+}
+
+////////////////////////////////////////////////////////////////////////
+// Root directory
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) TestRootMode(c *C) {
+	server, err := NewServer(&ServerConfig{
+		FilePerms: 0644,
+		DirPerms:  os.ModeSticky | 0777,
+	})
+	c.Assert(err, IsNil)
+
+	root := server.fs.getInode(fuseops.RootInodeID)
+	c.Check(root.attrs.Mode, Equals, os.ModeDir|os.ModeSticky|0777)
+}
+
+func (t *FileSystemTest) TestRootModeDefault(c *C) {
+	server, err := NewServer(&ServerConfig{FilePerms: 0644})
+	c.Assert(err, IsNil)
+
+	root := server.fs.getInode(fuseops.RootInodeID)
+	c.Check(root.attrs.Mode, Equals, os.ModeDir|0700)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Error codes
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) TestLookUpUnderFile(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+
+	err := t.fs.LookUpInode(t.ctx, &fuseops.LookUpInodeOp{
+		Parent: file,
+		Name:   "x",
+	})
+
+	c.Assert(err, Equals, syscall.ENOTDIR)
+}
+
+func (t *FileSystemTest) TestLookUpMissing(c *C) {
+	err := t.fs.LookUpInode(t.ctx, &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "x",
+	})
+
+	c.Assert(err, Equals, syscall.ENOENT)
+}
+
+func (t *FileSystemTest) TestLookUpNameTooLong(c *C) {
+	err := t.fs.LookUpInode(t.ctx, &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   strings.Repeat("x", maxNameLength+1),
+	})
+
+	c.Assert(err, Equals, syscall.ENAMETOOLONG)
+}
+
+func (t *FileSystemTest) TestGetAttributesOfUnknownInode(c *C) {
+	err := t.fs.GetInodeAttributes(t.ctx, &fuseops.GetInodeAttributesOp{
+		Inode: 1000,
+	})
+
+	c.Assert(err, Equals, syscall.ENOENT)
+}
+
+func (t *FileSystemTest) TestMkDirUnderFile(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+
+	err := t.fs.MkDir(t.ctx, &fuseops.MkDirOp{
+		Parent: file,
+		Name:   "d",
+		Mode:   os.ModeDir | 0755,
+	})
+
+	c.Assert(err, Equals, syscall.ENOTDIR)
+}
+
+func (t *FileSystemTest) TestMkDirExisting(c *C) {
+	t.mkFile(c, fuseops.RootInodeID, "f")
+
+	err := t.fs.MkDir(t.ctx, &fuseops.MkDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "f",
+		Mode:   os.ModeDir | 0755,
+	})
+
+	c.Assert(err, Equals, syscall.EEXIST)
+}
+
+func (t *FileSystemTest) TestCreateNameTooLong(c *C) {
+	err := t.fs.CreateFile(t.ctx, &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   strings.Repeat("x", maxNameLength+1),
+		Mode:   0644,
+	})
+
+	c.Assert(err, Equals, syscall.ENAMETOOLONG)
+}
+
+func (t *FileSystemTest) TestMkNodeDirectory(c *C) {
+	err := t.fs.MkNode(t.ctx, &fuseops.MkNodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "d",
+		Mode:   os.ModeDir | 0755,
+	})
+
+	c.Assert(err, Equals, syscall.EINVAL)
+}
+
+func (t *FileSystemTest) TestUnlinkDirectory(c *C) {
+	t.mkDir(c, fuseops.RootInodeID, "d")
+
+	err := t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "d",
+	})
+
+	c.Assert(err, Equals, syscall.EISDIR)
+}
+
+func (t *FileSystemTest) TestUnlinkMissing(c *C) {
+	err := t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "f",
+	})
+
+	c.Assert(err, Equals, syscall.ENOENT)
+}
+
+func (t *FileSystemTest) TestRmDirFile(c *C) {
+	t.mkFile(c, fuseops.RootInodeID, "f")
+
+	err := t.fs.RmDir(t.ctx, &fuseops.RmDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "f",
+	})
+
+	c.Assert(err, Equals, syscall.ENOTDIR)
+}
+
+func (t *FileSystemTest) TestRmDirNonEmpty(c *C) {
+	dir := t.mkDir(c, fuseops.RootInodeID, "d")
+	t.mkFile(c, dir, "f")
+
+	err := t.fs.RmDir(t.ctx, &fuseops.RmDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "d",
+	})
+
+	c.Assert(err, Equals, syscall.ENOTEMPTY)
+}
+
+func (t *FileSystemTest) TestCreateLinkToDirectory(c *C) {
+	dir := t.mkDir(c, fuseops.RootInodeID, "d")
+
+	err := t.fs.CreateLink(t.ctx, &fuseops.CreateLinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "l",
+		Target: dir,
+	})
+
+	c.Assert(err, Equals, syscall.EPERM)
+}
+
+func (t *FileSystemTest) TestCreateLinkUnderFile(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+
+	err := t.fs.CreateLink(t.ctx, &fuseops.CreateLinkOp{
+		Parent: file,
+		Name:   "l",
+		Target: file,
+	})
+
+	c.Assert(err, Equals, syscall.ENOTDIR)
+}
+
+func (t *FileSystemTest) TestCreateLinkToSymlink(c *C) {
+	symlink := t.mkSymlink(c, fuseops.RootInodeID, "s")
+
+	err := t.fs.CreateLink(t.ctx, &fuseops.CreateLinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "l",
+		Target: symlink,
+	})
+	c.Assert(err, IsNil)
+
+	root := t.fs.getInode(fuseops.RootInodeID)
+	id, dt, ok := root.LookUpChild("l")
+	c.Assert(ok, Equals, true)
+	c.Assert(id, Equals, symlink)
+	c.Assert(dt, Equals, fuseutil.DT_Link)
+}
+
+func (t *FileSystemTest) TestCreateLinkToUnlinkedFile(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+
+	err := t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "f",
+	})
+	c.Assert(err, IsNil)
+
+	err = t.fs.CreateLink(t.ctx, &fuseops.CreateLinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "l",
+		Target: file,
+	})
+
+	c.Assert(err, Equals, syscall.ENOENT)
+}
+
+func (t *FileSystemTest) TestRenameDirectoryOverFile(c *C) {
+	t.mkDir(c, fuseops.RootInodeID, "d")
+	t.mkFile(c, fuseops.RootInodeID, "f")
+
+	err := t.fs.Rename(t.ctx, &fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "d",
+		NewParent: fuseops.RootInodeID,
+		NewName:   "f",
+	})
+
+	c.Assert(err, Equals, syscall.ENOTDIR)
+}
+
+func (t *FileSystemTest) TestRenameFileOverDirectory(c *C) {
+	t.mkDir(c, fuseops.RootInodeID, "d")
+	t.mkFile(c, fuseops.RootInodeID, "f")
+
+	err := t.fs.Rename(t.ctx, &fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "f",
+		NewParent: fuseops.RootInodeID,
+		NewName:   "d",
+	})
+
+	c.Assert(err, Equals, syscall.EISDIR)
+}
+
+func (t *FileSystemTest) TestRenameDirectoryIntoItself(c *C) {
+	dir := t.mkDir(c, fuseops.RootInodeID, "d")
+	sub := t.mkDir(c, dir, "s")
+
+	err := t.fs.Rename(t.ctx, &fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "d",
+		NewParent: sub,
+		NewName:   "d",
+	})
+
+	c.Assert(err, Equals, syscall.EINVAL)
+}
+
+func (t *FileSystemTest) TestRenameUnderFile(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	t.mkFile(c, fuseops.RootInodeID, "g")
+
+	err := t.fs.Rename(t.ctx, &fuseops.RenameOp{
+		OldParent: fuseops.RootInodeID,
+		OldName:   "g",
+		NewParent: file,
+		NewName:   "g",
+	})
+
+	c.Assert(err, Equals, syscall.ENOTDIR)
+}
+
+func (t *FileSystemTest) TestOpenDirOnFile(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+
+	err := t.fs.OpenDir(t.ctx, &fuseops.OpenDirOp{
+		Inode: file,
+	})
+
+	c.Assert(err, Equals, syscall.ENOTDIR)
+}
+
+func (t *FileSystemTest) TestOpenFileOnDirectory(c *C) {
+	dir := t.mkDir(c, fuseops.RootInodeID, "d")
+
+	err := t.fs.OpenFile(t.ctx, &fuseops.OpenFileOp{
+		Inode: dir,
+	})
+
+	c.Assert(err, Equals, syscall.EISDIR)
+}
+
+func (t *FileSystemTest) TestReadSymlinkOnFile(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+
+	err := t.fs.ReadSymlink(t.ctx, &fuseops.ReadSymlinkOp{
+		Inode: file,
+	})
+
+	c.Assert(err, Equals, syscall.EINVAL)
+}
+
+func (t *FileSystemTest) TestTruncateDirectory(c *C) {
+	dir := t.mkDir(c, fuseops.RootInodeID, "d")
+	size := uint64(0)
+
+	err := t.fs.SetInodeAttributes(t.ctx, &fuseops.SetInodeAttributesOp{
+		Inode: dir,
+		Size:  &size,
+	})
+
+	c.Assert(err, Equals, syscall.EISDIR)
+}
+
+func (t *FileSystemTest) TestTruncateSymlink(c *C) {
+	symlink := t.mkSymlink(c, fuseops.RootInodeID, "s")
+	size := uint64(0)
+
+	err := t.fs.SetInodeAttributes(t.ctx, &fuseops.SetInodeAttributesOp{
+		Inode: symlink,
+		Size:  &size,
+	})
+
+	c.Assert(err, Equals, syscall.EINVAL)
+}
+
+func (t *FileSystemTest) TestReadUnknownHandle(c *C) {
+	err := t.fs.ReadFile(t.ctx, &fuseops.ReadFileOp{
+		Handle: 1000,
+		Dst:    make([]byte, 1),
+	})
+
+	c.Assert(err, Equals, syscall.EBADF)
+}
+
+func (t *FileSystemTest) TestForgetMoreThanLookedUp(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+
+	err := t.fs.ForgetInode(t.ctx, &fuseops.ForgetInodeOp{Inode: file, N: 5})
+	c.Assert(err, Equals, syscall.EIO)
+
+	// The inode is still there.
+	_, err = t.fs.findInode(file)
+	c.Assert(err, IsNil)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Limits
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) statFS(c *C) *fuseops.StatFSOp {
+	op := &fuseops.StatFSOp{}
+	c.Assert(t.fs.StatFS(t.ctx, op), IsNil)
+	return op
+}
+
+func (t *FileSystemTest) TestStatFSWithoutLimits(c *C) {
+	op := t.statFS(c)
+	c.Check(op.Blocks, Equals, uint64(1<<33))
+	c.Check(op.BlocksFree, Equals, op.Blocks)
+	c.Check(op.Inodes, Equals, uint64(1<<50))
+	c.Check(op.InodesFree, Equals, op.Inodes-1)
+}
+
+func (t *FileSystemTest) TestStatFSWithLimits(c *C) {
+	t.fs.sizeLimit = 8 << 17
+	t.fs.inodeLimit = 10
+
+	// A block and a page count as two blocks in use.
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+	t.write(c, handle, 0, strings.Repeat("x", 1<<17+1))
+
+	op := t.statFS(c)
+	c.Check(op.Blocks, Equals, uint64(8))
+	c.Check(op.BlocksFree, Equals, uint64(6))
+	c.Check(op.BlocksAvailable, Equals, uint64(6))
+	c.Check(op.Inodes, Equals, uint64(10))
+	c.Check(op.InodesFree, Equals, uint64(8))
+}
+
+func (t *FileSystemTest) TestInodeLimit(c *C) {
+	t.fs.inodeLimit = 3
+	t.mkFile(c, fuseops.RootInodeID, "f")
+	file := t.mkFile(c, fuseops.RootInodeID, "g")
+
+	err := t.fs.MkNode(t.ctx, &fuseops.MkNodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "h",
+		Mode:   0644,
+	})
+
+	c.Check(err, Equals, syscall.ENOSPC)
+
+	err = t.fs.MkDir(t.ctx, &fuseops.MkDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "dir",
+		Mode:   os.ModeDir | 0755,
+	})
+
+	c.Check(err, Equals, syscall.ENOSPC)
+	c.Check(t.statFS(c).InodesFree, Equals, uint64(0))
+
+	// Freeing an inode makes room for another.
+	err = t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "g"})
+	c.Assert(err, IsNil)
+	err = t.fs.ForgetInode(t.ctx, &fuseops.ForgetInodeOp{Inode: file, N: 1})
+	c.Assert(err, IsNil)
+
+	t.mkFile(c, fuseops.RootInodeID, "h")
+}
+
+func (t *FileSystemTest) TestSizeLimit(c *C) {
+	t.fs.sizeLimit = 2 * pageSize
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+	t.write(c, handle, 0, strings.Repeat("x", 2*pageSize))
+
+	// Another page doesn't fit, and the file is left as it was.
+	err := t.fs.WriteFile(t.ctx, &fuseops.WriteFileOp{
+		Handle: handle,
+		Offset: 2 * pageSize,
+		Data:   []byte("taco"),
+	})
+
+	c.Check(err, Equals, syscall.ENOSPC)
+	c.Check(t.fs.getInode(file).attrs.Size, Equals, uint64(2*pageSize))
+
+	// Truncating gives space back.
+	t.truncate(c, file, pageSize)
+	c.Check(t.fs.usedBytes, Equals, uint64(pageSize))
+	t.write(c, handle, pageSize, "taco")
+}
+
+func (t *FileSystemTest) TestUnlinkGivesSpaceBack(c *C) {
+	t.fs.sizeLimit = 2 * pageSize
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+	t.write(c, handle, 0, strings.Repeat("x", 2*pageSize))
+
+	err := t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "f"})
+	c.Assert(err, IsNil)
+	err = t.fs.ReleaseFileHandle(t.ctx, &fuseops.ReleaseFileHandleOp{Handle: handle})
+	c.Assert(err, IsNil)
+
+	// The kernel still knows the file, so its space is still in use.
+	c.Check(t.fs.usedBytes, Equals, uint64(2*pageSize))
+
+	err = t.fs.ForgetInode(t.ctx, &fuseops.ForgetInodeOp{Inode: file, N: 1})
+	c.Assert(err, IsNil)
+	c.Check(t.fs.usedBytes, Equals, uint64(0))
+
+	file = t.mkFile(c, fuseops.RootInodeID, "g")
+	t.write(c, t.openFile(c, file, syscall.O_RDWR), 0, strings.Repeat("x", 2*pageSize))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Reclaiming inodes
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) forget(c *C, inode fuseops.InodeID, n uint64) {
+	err := t.fs.ForgetInode(t.ctx, &fuseops.ForgetInodeOp{Inode: inode, N: n})
+	c.Assert(err, IsNil)
+}
+
+func (t *FileSystemTest) TestInodeFreedOnceUnreferenced(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	t.lookUp(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+	t.write(c, handle, 0, "taco")
+
+	// Each of the link, the two lookups and the handle keeps it alive.
+	err := t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "f"})
+	c.Assert(err, IsNil)
+	c.Check(t.fs.getInode(file), NotNil)
+
+	t.forget(c, file, 1)
+	c.Check(t.fs.getInode(file), NotNil)
+
+	err = t.fs.ReleaseFileHandle(t.ctx, &fuseops.ReleaseFileHandleOp{Handle: handle})
+	c.Assert(err, IsNil)
+	c.Check(t.fs.getInode(file), NotNil)
+	c.Check(t.fs.usedBytes, Equals, uint64(pageSize))
+
+	t.forget(c, file, 1)
+	c.Check(t.fs.getInode(file), IsNil)
+	c.Check(t.fs.usedBytes, Equals, uint64(0))
+
+	// Its ID goes to the next inode.
+	c.Check(t.mkFile(c, fuseops.RootInodeID, "g"), Equals, file)
+}
+
+func (t *FileSystemTest) TestForgottenInodeLivesWhileLinked(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	link := &fuseops.CreateLinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "g",
+		Target: file,
+	}
+
+	c.Assert(t.fs.CreateLink(t.ctx, link), IsNil)
+
+	// The kernel forgets it, but the directory entries remain.
+	t.forget(c, file, 2)
+	c.Check(t.fs.getInode(file), NotNil)
+
+	err := t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "f"})
+	c.Assert(err, IsNil)
+	c.Check(t.fs.getInode(file), NotNil)
+
+	// Removing the last one frees it straight away.
+	err = t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: "g"})
+	c.Assert(err, IsNil)
+	c.Check(t.fs.getInode(file), IsNil)
+}
+
+func (t *FileSystemTest) TestBatchForget(c *C) {
+	f := t.mkFile(c, fuseops.RootInodeID, "f")
+	g := t.mkFile(c, fuseops.RootInodeID, "g")
+	for _, name := range []string{"f", "g"} {
+		err := t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{Parent: fuseops.RootInodeID, Name: name})
+		c.Assert(err, IsNil)
+	}
+
+	err := t.fs.BatchForget(t.ctx, &fuseops.BatchForgetOp{
+		Entries: []fuseops.BatchForgetEntry{
+			{Inode: f, N: 1},
+			{Inode: g, N: 1},
+		},
+	})
+
+	c.Assert(err, IsNil)
+	c.Check(t.fs.getInode(f), IsNil)
+	c.Check(t.fs.getInode(g), IsNil)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Concurrency
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) TestConcurrentOps(c *C) {
+	const iterations = 200
+
+	// Two directories, each with a subdirectory and some files, to move
+	// things between.
+	dirs := []fuseops.InodeID{
+		t.mkDir(c, fuseops.RootInodeID, "a"),
+		t.mkDir(c, fuseops.RootInodeID, "b"),
+	}
+
+	dirs = append(dirs, t.mkDir(c, dirs[0], "sub"), t.mkDir(c, dirs[1], "sub"))
+
+	var handles []fuseops.HandleID
+	for i, dir := range dirs {
+		file := t.mkFile(c, dir, fmt.Sprintf("f%d", i))
+		handles = append(handles, t.openFile(c, file, syscall.O_RDWR))
+	}
+
+	// Run every kind of op at once. Most of them race with each other and
+	// fail now and then, which is fine; the point is that none of them
+	// deadlock or race.
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				f(i)
+			}
+		}()
+	}
+
+	// Move files and whole directories back and forth across parents,
+	// including into and out of each other's subdirectories.
+	run(func(i int) {
+		from, to := dirs[i%4], dirs[(i+1)%4]
+		t.fs.Rename(t.ctx, &fuseops.RenameOp{
+			OldParent: from,
+			OldName:   fmt.Sprintf("f%d", i%4),
+			NewParent: to,
+			NewName:   fmt.Sprintf("f%d", i%4),
+		})
+	})
+
+	run(func(i int) {
+		from, to := dirs[i%2], dirs[(i+1)%2]
+		t.fs.Rename(t.ctx, &fuseops.RenameOp{
+			OldParent: from,
+			OldName:   "moved",
+			NewParent: to,
+			NewName:   "moved",
+		})
+	})
+
+	run(func(i int) {
+		// Only ever one of these exists.
+		op := &fuseops.MkDirOp{Parent: dirs[0], Name: "moved", Mode: os.ModeDir | 0755}
+		if t.fs.MkDir(t.ctx, op) == nil {
+			t.fs.ForgetInode(t.ctx, &fuseops.ForgetInodeOp{Inode: op.Entry.Child, N: 1})
+		}
+
+		t.fs.RmDir(t.ctx, &fuseops.RmDirOp{Parent: dirs[i%2], Name: "moved"})
+	})
+
+	// Look names up, list directories and make and remove files in them.
+	run(func(i int) {
+		op := &fuseops.LookUpInodeOp{Parent: dirs[i%4], Name: fmt.Sprintf("f%d", i%4)}
+		if t.fs.LookUpInode(t.ctx, op) == nil && op.Entry.Child != 0 {
+			t.fs.ForgetInode(t.ctx, &fuseops.ForgetInodeOp{Inode: op.Entry.Child, N: 1})
+		}
+	})
+
+	run(func(i int) {
+		open := &fuseops.OpenDirOp{Inode: dirs[i%4]}
+		if t.fs.OpenDir(t.ctx, open) != nil {
+			return
+		}
+
+		t.fs.ReadDir(t.ctx, &fuseops.ReadDirOp{
+			Inode:  dirs[i%4],
+			Handle: open.Handle,
+			Dst:    make([]byte, 1024),
+		})
+
+		t.fs.ReleaseDirHandle(t.ctx, &fuseops.ReleaseDirHandleOp{Handle: open.Handle})
+	})
+
+	run(func(i int) {
+		op := &fuseops.MkNodeOp{Parent: dirs[i%4], Name: "tmp", Mode: 0644}
+		if t.fs.MkNode(t.ctx, op) == nil {
+			t.fs.ForgetInode(t.ctx, &fuseops.ForgetInodeOp{Inode: op.Entry.Child, N: 1})
+		}
+
+		t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{Parent: dirs[(i+1)%4], Name: "tmp"})
+	})
+
+	// Write to and read from the files wherever they are.
+	run(func(i int) {
+		t.fs.WriteFile(t.ctx, &fuseops.WriteFileOp{
+			Handle: handles[i%4],
+			Offset: int64(i) * 100,
+			Data:   []byte("taco"),
+		})
+
+		t.fs.ReadFile(t.ctx, &fuseops.ReadFileOp{
+			Handle: handles[(i+1)%4],
+			Dst:    make([]byte, 100),
+		})
+	})
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		c.Fatal("Deadlocked")
+	}
+
+	// The tree is still consistent.
+	t.fs.mu.Lock()
+	t.fs.checkInvariants()
+	t.fs.mu.Unlock()
+
+	for id := fuseops.InodeID(fuseops.RootInodeID); ; id++ {
+		in := t.fs.getInode(id)
+		if in == nil {
+			if int(id) >= len(t.fs.inodes) {
+				break
+			}
+
+			continue
+		}
+
+		c.Check(checkInodeInvariants(in), IsNil)
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// Panics
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) TestPanicFailsOpWithEIO(c *C) {
+	fs := recoveringFileSystem{t.fs}
+	op := &fuseops.ReadFileOp{}
+
+	err := func() (err error) {
+		defer fs.recover(op, &err)
+		defer fs.enter()()
+		panic("taco")
+	}()
+
+	c.Assert(err, Equals, syscall.EIO)
+
+	// The op let go of the checkpoint lock on its way out.
+	t.fs.opsMu.Lock()
+	t.fs.opsMu.Unlock()
+
+	// And the file system carries on serving.
+	create := &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "f",
+		Mode:   0644,
+	}
+
+	c.Assert(fs.CreateFile(t.ctx, create), IsNil)
+}
+
+func (t *FileSystemTest) TestInvariantViolationNotRecovered(c *C) {
+	fs := recoveringFileSystem{t.fs}
+	op := &fuseops.ReadFileOp{}
+
+	// A failed invariant check may have left its lock held, so the panic
+	// carries on rather than becoming EIO.
+	f := func() {
+		var err error
+		defer fs.recover(op, &err)
+		invariantCheck(func() { panic("taco") })()
+	}
+
+	c.Check(f, PanicMatches, "taco")
+}
+
+func (t *FileSystemTest) TestSummary(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	t.openFile(c, file, syscall.O_RDWR)
+	t.mkDir(c, fuseops.RootInodeID, "d")
+
+	c.Check(
+		t.fs.summary(),
+		Equals,
+		"State: 3 inodes (limit 0), 1 open handles, 0 of 0 bytes used")
+}
+
+func (t *FileSystemTest) TestWrapperPassesErrorsThrough(c *C) {
+	fs := recoveringFileSystem{t.fs}
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+
+	err := fs.LookUpInode(t.ctx, &fuseops.LookUpInodeOp{Parent: file, Name: "x"})
+	c.Check(err, Equals, syscall.ENOTDIR)
+
+	err = fs.OpenFile(t.ctx, &fuseops.OpenFileOp{Inode: fuseops.RootInodeID})
+	c.Check(err, Equals, syscall.EISDIR)
+
+	err = fs.GetInodeAttributes(t.ctx, &fuseops.GetInodeAttributesOp{Inode: 999})
+	c.Check(err, Equals, syscall.ENOENT)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Directory entries
+////////////////////////////////////////////////////////////////////////
+
+// Read entries of the directory through the given handle, after the given
+// offset and into a buffer of the given size, and decode them. Dirents are
+// written in host byte order, which is little-endian wherever fuse runs.
+func (t *FileSystemTest) listDir(
+	c *C,
+	dir fuseops.InodeID,
+	handle fuseops.HandleID,
+	offset fuseops.DirOffset,
+	size int) (entries []fuseutil.Dirent) {
+	op := &fuseops.ReadDirOp{
+		Inode:  dir,
+		Handle: handle,
+		Offset: offset,
+		Dst:    make([]byte, size),
+	}
+
+	c.Assert(t.fs.ReadDir(t.ctx, op), IsNil)
+
+	p := op.Dst[:op.BytesRead]
+	for len(p) != 0 {
+		nameLen := int(binary.LittleEndian.Uint32(p[16:]))
+		entries = append(entries, fuseutil.Dirent{
+			Inode:  fuseops.InodeID(binary.LittleEndian.Uint64(p[0:])),
+			Offset: fuseops.DirOffset(binary.LittleEndian.Uint64(p[8:])),
+			Type:   fuseutil.DirentType(binary.LittleEndian.Uint32(p[20:])),
+			Name:   string(p[24 : 24+nameLen]),
+		})
+
+		p = p[(24+nameLen+7)&^7:]
+	}
+
+	return
+}
+
+func (t *FileSystemTest) TestReadDirWhileRemoving(c *C) {
+	const n = 100
+	dir := t.mkDir(c, fuseops.RootInodeID, "dir")
+	ids := make(map[string]fuseops.InodeID)
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("f%02d", i)
+		ids[name] = t.mkFile(c, dir, name)
+	}
+
+	open := &fuseops.OpenDirOp{Inode: dir}
+	c.Assert(t.fs.OpenDir(t.ctx, open), IsNil)
+
+	// Read the directory past "." and ".." eight entries at a time, and after
+	// each batch remove the four files read last and the four due next.
+	// Removing half the entries compacts the directory along the way.
+	var seen []string
+	hidden := make(map[string]bool)
+	offset := fuseops.DirOffset(dotDotOffset)
+	for {
+		entries := t.listDir(c, dir, open.Handle, offset, 8*32)
+		if len(entries) == 0 {
+			break
+		}
+
+		var last int
+		for _, e := range entries {
+			seen = append(seen, e.Name)
+			offset = e.Offset
+			fmt.Sscanf(e.Name, "f%d", &last)
+		}
+
+		for i := last - 3; i <= last+4 && i < n; i++ {
+			name := fmt.Sprintf("f%02d", i)
+			if _, ok := ids[name]; !ok {
+				continue
+			}
+
+			err := t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{Parent: dir, Name: name})
+			c.Assert(err, IsNil)
+			delete(ids, name)
+			hidden[name] = i > last
+		}
+	}
+
+	// Every file was listed once and in order, unless it was removed before
+	// its turn came.
+	var expected []string
+	for i := 0; i < n; i++ {
+		if name := fmt.Sprintf("f%02d", i); !hidden[name] {
+			expected = append(expected, name)
+		}
+	}
+
+	c.Check(seen, DeepEquals, expected)
+
+	// Lookups find the files that are left through the compacted index.
+	in := t.fs.getInode(dir)
+	c.Check(len(in.entries) < n, Equals, true)
+	c.Check(checkInodeInvariants(in), IsNil)
+
+	for name, id := range ids {
+		c.Check(t.lookUp(c, dir, name), Equals, id)
+	}
+
+	c.Check(in.Len(), Equals, len(ids))
+	_, _, ok := in.LookUpChild("f04")
+	c.Check(ok, Equals, false)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Open handles
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) TestUnlinkedFileStaysOpen(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+	t.write(c, handle, 0, "taco")
+
+	err := t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "f",
+	})
+
+	c.Assert(err, IsNil)
+
+	// The kernel forgets the name, but the handle keeps the file alive.
+	err = t.fs.ForgetInode(t.ctx, &fuseops.ForgetInodeOp{Inode: file, N: 1})
+	c.Assert(err, IsNil)
+
+	t.write(c, handle, 4, "burrito")
+	c.Check(t.read(c, handle, 0, 100), Equals, "tacoburrito")
+	c.Check(t.fs.getInode(file).attrs.Nlink, Equals, uint32(0))
+	c.Check(t.fs.usedBytes, Equals, uint64(pageSize))
+
+	// Closing it frees the inode and its contents.
+	err = t.fs.ReleaseFileHandle(t.ctx, &fuseops.ReleaseFileHandleOp{Handle: handle})
+	c.Assert(err, IsNil)
+	c.Check(t.fs.getInode(file), IsNil)
+	c.Check(t.fs.usedBytes, Equals, uint64(0))
+}
+
+func (t *FileSystemTest) TestUnlinkedFileWithSeveralHandles(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	first := t.openFile(c, file, syscall.O_RDWR)
+	second := t.openFile(c, file, syscall.O_RDONLY)
+
+	err := t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "f",
+	})
+
+	c.Assert(err, IsNil)
+	err = t.fs.ForgetInode(t.ctx, &fuseops.ForgetInodeOp{Inode: file, N: 1})
+	c.Assert(err, IsNil)
+
+	// Writes through one handle show through the other, until the last is
+	// closed.
+	t.write(c, first, 0, "taco")
+	err = t.fs.ReleaseFileHandle(t.ctx, &fuseops.ReleaseFileHandleOp{Handle: first})
+	c.Assert(err, IsNil)
+	c.Check(t.read(c, second, 0, 100), Equals, "taco")
+
+	err = t.fs.ReleaseFileHandle(t.ctx, &fuseops.ReleaseFileHandleOp{Handle: second})
+	c.Assert(err, IsNil)
+	c.Check(t.fs.getInode(file), IsNil)
+}
+
+func (t *FileSystemTest) TestRemovedDirectoryStaysOpen(c *C) {
+	dir := t.mkDir(c, fuseops.RootInodeID, "dir")
+	open := &fuseops.OpenDirOp{Inode: dir}
+	c.Assert(t.fs.OpenDir(t.ctx, open), IsNil)
+
+	err := t.fs.RmDir(t.ctx, &fuseops.RmDirOp{Parent: fuseops.RootInodeID, Name: "dir"})
+	c.Assert(err, IsNil)
+	err = t.fs.ForgetInode(t.ctx, &fuseops.ForgetInodeOp{Inode: dir, N: 1})
+	c.Assert(err, IsNil)
+	c.Check(t.fs.getInode(dir), NotNil)
+
+	err = t.fs.ReleaseDirHandle(t.ctx, &fuseops.ReleaseDirHandleOp{Handle: open.Handle})
+	c.Assert(err, IsNil)
+	c.Check(t.fs.getInode(dir), IsNil)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Snapshots
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) TestSnapshotRoundTrip(c *C) {
+	dir := t.mkDir(c, fuseops.RootInodeID, "dir")
+	file := t.mkFile(c, dir, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+
+	// Data on either side of a hole, and a run of pages longer than a single
+	// record.
+	t.write(c, handle, 3, "taco")
+	t.write(c, handle, 10*pageSize, strings.Repeat("x", (snapshotRunPages+1)*pageSize))
+	t.mkSymlink(c, dir, "symlink")
+
+	path := c.MkDir() + "/snapshot"
+	c.Assert((&Server{fs: t.fs}).SaveSnapshot(path), IsNil)
+
+	server, err := NewServer(&ServerConfig{
+		FilePerms:    0644,
+		DirPerms:     0755,
+		SnapshotFile: path,
+	})
+
+	c.Assert(err, IsNil)
+	saved := t.fs
+	t.fs = server.fs
+
+	c.Check(t.lookUp(c, fuseops.RootInodeID, "dir"), Equals, dir)
+	c.Check(t.lookUp(c, dir, "f"), Equals, file)
+	c.Check(t.fs.getInode(dir).attrs.Nlink, Equals, uint32(2))
+	c.Check(t.fs.getInode(t.lookUp(c, dir, "symlink")).target, Equals, "target")
+	c.Check(t.fs.usedBytes, Equals, saved.usedBytes)
+
+	in := t.fs.getInode(file)
+	c.Check(in.attrs.Size, Equals, saved.getInode(file).attrs.Size)
+	c.Check(in.contents.pageIndices(), DeepEquals, saved.getInode(file).contents.pageIndices())
+
+	buf := make([]byte, in.attrs.Size)
+	_, err = in.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Check(string(buf[:8]), Equals, "\x00\x00\x00taco\x00")
+	c.Check(string(buf[10*pageSize:]), Equals, strings.Repeat("x", (snapshotRunPages+1)*pageSize))
+}
+
+func (t *FileSystemTest) TestSnapshotTruncated(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	t.write(c, t.openFile(c, file, syscall.O_RDWR), 0, "taco")
+
+	path := c.MkDir() + "/snapshot"
+	c.Assert((&Server{fs: t.fs}).SaveSnapshot(path), IsNil)
+
+	fi, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Assert(os.Truncate(path, fi.Size()-100), IsNil)
+
+	_, err = NewServer(&ServerConfig{SnapshotFile: path})
+	c.Check(err, ErrorMatches, ".*Decode: unexpected EOF")
+}
+
+////////////////////////////////////////////////////////////////////////
+// Journal
+////////////////////////////////////////////////////////////////////////
+
+// Start a new file system with a journal at the given path, recovering
+// whatever it holds, as after a crash.
+func (t *FileSystemTest) mountJournal(c *C, path string) *Server {
+	server, err := NewServer(&ServerConfig{
+		FilePerms:   0644,
+		DirPerms:    0755,
+		JournalFile: path,
+	})
+
+	c.Assert(err, IsNil)
+	t.fs = server.fs
+	return server
+}
+
+func (t *FileSystemTest) sync(c *C) {
+	c.Assert(t.fs.SyncFile(t.ctx, &fuseops.SyncFileOp{}), IsNil)
+}
+
+func (t *FileSystemTest) TestJournalReplay(c *C) {
+	path := c.MkDir() + "/journal"
+	t.mountJournal(c, path)
+
+	dir := t.mkDir(c, fuseops.RootInodeID, "dir")
+	file := t.mkFile(c, dir, "f")
+	t.write(c, t.openFile(c, file, syscall.O_RDWR), 0, "taco burrito")
+
+	err := t.fs.Rename(t.ctx, &fuseops.RenameOp{
+		OldParent: dir,
+		OldName:   "f",
+		NewParent: fuseops.RootInodeID,
+		NewName:   "g",
+	})
+
+	c.Assert(err, IsNil)
+
+	err = t.fs.SetXattr(t.ctx, &fuseops.SetXattrOp{
+		Inode: file,
+		Name:  "user.foo",
+		Value: []byte("bar"),
+	})
+
+	c.Assert(err, IsNil)
+
+	size := uint64(4)
+	err = t.fs.SetInodeAttributes(t.ctx, &fuseops.SetInodeAttributesOp{
+		Inode: file,
+		Size:  &size,
+	})
+
+	c.Assert(err, IsNil)
+	t.sync(c)
+
+	// Crash, and come back.
+	t.mountJournal(c, path)
+	c.Check(t.lookUp(c, fuseops.RootInodeID, "g"), Equals, file)
+	c.Check(t.fs.getInode(dir).entries, HasLen, 0)
+
+	in := t.fs.getInode(file)
+	c.Check(string(in.xattrs["user.foo"]), Equals, "bar")
+
+	buf := make([]byte, in.attrs.Size)
+	_, err = in.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Check(string(buf), Equals, "taco")
+}
+
+func (t *FileSystemTest) TestJournalTruncatedTail(c *C) {
+	path := c.MkDir() + "/journal"
+	t.mountJournal(c, path)
+
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+	t.write(c, handle, 0, "taco")
+	t.sync(c)
+
+	fi, err := os.Stat(path)
+	c.Assert(err, IsNil)
+
+	// A crash in the middle of appending the second write leaves part of it.
+	t.write(c, handle, 4, "burrito")
+	t.sync(c)
+	c.Assert(os.Truncate(path, fi.Size()+5), IsNil)
+
+	t.mountJournal(c, path)
+	in := t.fs.getInode(t.lookUp(c, fuseops.RootInodeID, "f"))
+	c.Check(in.attrs.Size, Equals, uint64(4))
+}
+
+func (t *FileSystemTest) TestJournalOlderThanCheckpoint(c *C) {
+	path := c.MkDir() + "/journal"
+	server := t.mountJournal(c, path)
+	t.mkFile(c, fuseops.RootInodeID, "f")
+	t.sync(c)
+
+	old, err := os.ReadFile(path)
+	c.Assert(err, IsNil)
+
+	// The checkpoint written on close covers the old journal, which must not
+	// be applied again.
+	c.Assert(server.Close(), IsNil)
+	c.Assert(os.WriteFile(path, old, 0600), IsNil)
+
+	t.mountJournal(c, path)
+	t.lookUp(c, fuseops.RootInodeID, "f")
+}
+
+func (t *FileSystemTest) TestJournalNewerThanCheckpoint(c *C) {
+	path := c.MkDir() + "/journal"
+	t.mountJournal(c, path)
+	t.mkFile(c, fuseops.RootInodeID, "f")
+	t.sync(c)
+
+	// Losing the checkpoint must not silently lose the synced file.
+	c.Assert(os.Remove(path+checkpointSuffix), IsNil)
+
+	_, err := NewServer(&ServerConfig{JournalFile: path})
+	c.Check(err, ErrorMatches, ".*Journal generation 1 is newer than checkpoint generation 0")
+}
+
+func (t *FileSystemTest) TestJournalUnlinkedOpenFileAcrossCheckpoint(c *C) {
+	path := c.MkDir() + "/journal"
+	t.mountJournal(c, path)
+
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+	t.write(c, handle, 0, "taco")
+
+	err := t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "f",
+	})
+
+	c.Assert(err, IsNil)
+	c.Assert(t.fs.checkpoint(), IsNil)
+
+	// The journal goes on changing and then freeing the file.
+	t.write(c, handle, 0, "burrito")
+	err = t.fs.ReleaseFileHandle(t.ctx, &fuseops.ReleaseFileHandleOp{Handle: handle})
+	c.Assert(err, IsNil)
+	err = t.fs.ForgetInode(t.ctx, &fuseops.ForgetInodeOp{Inode: file, N: 1})
+	c.Assert(err, IsNil)
+	t.sync(c)
+
+	// Crash, and come back.
+	t.mountJournal(c, path)
+	c.Check(t.fs.getInode(file), IsNil)
+	c.Check(t.fs.usedBytes, Equals, uint64(0))
+}
+
+func (t *FileSystemTest) TestJournalUnlinkedOpenFileAtCrash(c *C) {
+	path := c.MkDir() + "/journal"
+	t.mountJournal(c, path)
+
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+
+	err := t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "f",
+	})
+
+	c.Assert(err, IsNil)
+	c.Assert(t.fs.checkpoint(), IsNil)
+	t.write(c, handle, 0, "taco")
+	t.sync(c)
+
+	// Crash while the file is still open. Nothing can reach it afterwards.
+	t.mountJournal(c, path)
+	c.Check(t.fs.getInode(file), IsNil)
+	c.Check(t.fs.usedBytes, Equals, uint64(0))
+}
+
+func (t *FileSystemTest) TestJournalRemovedDirectoryAcrossCheckpoint(c *C) {
+	path := c.MkDir() + "/journal"
+	t.mountJournal(c, path)
+
+	// The kernel still knows the directory when the checkpoint is written.
+	dir := t.mkDir(c, fuseops.RootInodeID, "dir")
+	err := t.fs.RmDir(t.ctx, &fuseops.RmDirOp{Parent: fuseops.RootInodeID, Name: "dir"})
+	c.Assert(err, IsNil)
+	c.Assert(t.fs.checkpoint(), IsNil)
+
+	t.mountJournal(c, path)
+	c.Check(t.fs.getInode(dir), IsNil)
+	c.Check(t.fs.getInode(fuseops.RootInodeID).attrs.Nlink, Equals, uint32(2))
+}
+
+func (t *FileSystemTest) TestCheckpointReportsCloseError(c *C) {
+	path := c.MkDir() + "/journal"
+	t.mountJournal(c, path)
+	t.mkDir(c, fuseops.RootInodeID, "dir")
+
+	// Pull the old journal's file out from under it.
+	c.Assert(t.fs.journal.f.Close(), IsNil)
+	c.Check(t.fs.checkpoint(), ErrorMatches, "Closing journal: .*file already closed")
+
+	// The checkpoint was written and the new journal works.
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	t.sync(c)
+
+	t.mountJournal(c, path)
+	t.lookUp(c, fuseops.RootInodeID, "dir")
+	c.Check(t.lookUp(c, fuseops.RootInodeID, "f"), Equals, file)
+}
+
+func (t *FileSystemTest) TestJournalCheckpointsInBackground(c *C) {
+	path := c.MkDir() + "/journal"
+	t.mountJournal(c, path)
+	t.fs.checkpointMinJournalSize = 64 << 10
+
+	// Keep rewriting the same page, through the wrapper that keeps ops and
+	// checkpoints apart, until the journal is well past the threshold.
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+	fs := recoveringFileSystem{t.fs}
+	for i := 0; i < 64; i++ {
+		err := fs.WriteFile(t.ctx, &fuseops.WriteFileOp{
+			Handle: handle,
+			Data:   []byte(strings.Repeat(string(rune('a'+i%26)), pageSize)),
+		})
+
+		c.Assert(err, IsNil)
+	}
+
+	c.Assert(fs.SyncFile(t.ctx, &fuseops.SyncFileOp{}), IsNil)
+
+	// Wait for the checkpoint.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		leave := fs.enter()
+		generation := t.fs.journalGeneration
+		leave()
+
+		if generation > 1 {
+			break
+		}
+
+		c.Assert(time.Now().Before(deadline), Equals, true)
+		time.Sleep(time.Millisecond)
+	}
+
+	fi, err := os.Stat(path)
+	c.Assert(err, IsNil)
+	c.Check(fi.Size() < t.fs.checkpointMinJournalSize, Equals, true)
+
+	// Nothing is lost.
+	t.mountJournal(c, path)
+	in := t.fs.getInode(t.lookUp(c, fuseops.RootInodeID, "f"))
+
+	buf := make([]byte, pageSize)
+	_, err = in.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Check(string(buf), Equals, strings.Repeat("l", pageSize))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Sparse contents
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) TestSparseFile(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+
+	// A huge file takes no memory until written, and then only the pages
+	// written to.
+	t.truncate(c, file, 100<<30)
+	c.Check(t.fs.usedBytes, Equals, uint64(0))
+
+	t.write(c, handle, 10<<30+pageSize-6, "hello world")
+	c.Check(t.fs.usedBytes, Equals, uint64(2*pageSize))
+	c.Check(
+		t.read(c, handle, 10<<30+pageSize-16, 30),
+		Equals,
+		strings.Repeat("\x00", 10)+"hello world"+strings.Repeat("\x00", 9))
+
+	// Shrinking into a page releases the pages past it, and extending again
+	// reads zeros rather than the old data.
+	t.truncate(c, file, 10<<30+pageSize-1)
+	t.truncate(c, file, 20<<30)
+	c.Check(t.fs.usedBytes, Equals, uint64(pageSize))
+	c.Check(t.read(c, handle, 10<<30+pageSize-6, 10), Equals, "hello\x00\x00\x00\x00\x00")
+}
+
+func (t *FileSystemTest) TestSparseWriteAtSizeLimit(c *C) {
+	t.fs.sizeLimit = 2 * pageSize
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+
+	// Writes far apart need a page each, wherever they are.
+	t.write(c, handle, 0, "taco")
+	t.write(c, handle, 1<<40, "taco")
+
+	err := t.fs.WriteFile(t.ctx, &fuseops.WriteFileOp{
+		Handle: handle,
+		Offset: 1 << 30,
+		Data:   []byte("taco"),
+	})
+
+	c.Check(err, Equals, syscall.ENOSPC)
+
+	// Rewriting allocated pages needs no more space.
+	t.write(c, handle, 1<<40+pageSize-4, "taco")
+}
+
+////////////////////////////////////////////////////////////////////////
+// Special files
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) TestMkNodeSpecialFiles(c *C) {
+	// The kernel checks who may make device nodes before asking, so anyone
+	// with write access to the directory may as far as we are concerned.
+	t.fs.getInode(fuseops.RootInodeID).attrs.Mode = os.ModeDir | 0777
+	user := fuseops.OpContext{Uid: 1000, Gid: 1000}
+
+	nodes := []struct {
+		name string
+		mode os.FileMode
+		rdev uint32
+		typ  fuseutil.DirentType
+	}{
+		{"fifo", os.ModeNamedPipe | 0644, 0, fuseutil.DT_FIFO},
+		{"socket", os.ModeSocket | 0644, 0, fuseutil.DT_Socket},
+		{"char", os.ModeDevice | os.ModeCharDevice | 0644, 0x103, fuseutil.DT_Char},
+		{"block", os.ModeDevice | 0644, 0x801, fuseutil.DT_Block},
+	}
+
+	for _, n := range nodes {
+		op := &fuseops.MkNodeOp{
+			Parent:    fuseops.RootInodeID,
+			Name:      n.name,
+			Mode:      n.mode,
+			Rdev:      n.rdev,
+			OpContext: user,
+		}
+
+		c.Assert(t.fs.MkNode(t.ctx, op), IsNil, Commentf("%s", n.name))
+		c.Check(op.Entry.Attributes.Mode, Equals, n.mode)
+		c.Check(op.Entry.Attributes.Rdev, Equals, n.rdev)
+		c.Check(op.Entry.Attributes.Uid, Equals, uint32(1000))
+
+		_, typ, _ := t.fs.getInode(fuseops.RootInodeID).LookUpChild(n.name)
+		c.Check(typ, Equals, n.typ)
+	}
+}
+
+func (t *FileSystemTest) TestMkNodeIgnoresRdevOfFifo(c *C) {
+	op := &fuseops.MkNodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "fifo",
+		Mode:   os.ModeNamedPipe | 0644,
+		Rdev:   0x103,
+	}
+
+	c.Assert(t.fs.MkNode(t.ctx, op), IsNil)
+	c.Check(op.Entry.Attributes.Rdev, Equals, uint32(0))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Fallocate
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) TestFallocatePreallocates(c *C) {
+	t.fs.sizeLimit = 10 * pageSize
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+	in := t.fs.getInode(file)
+
+	// Extending the file.
+	c.Assert(t.fallocate(handle, 0, 100, 2*pageSize), IsNil)
+	c.Check(in.attrs.Size, Equals, uint64(100+2*pageSize))
+	c.Check(t.fs.usedBytes, Equals, uint64(3*pageSize))
+
+	// Past the end, keeping the size.
+	c.Assert(t.fallocate(handle, unix.FALLOC_FL_KEEP_SIZE, 5*pageSize, pageSize), IsNil)
+	c.Check(in.attrs.Size, Equals, uint64(100+2*pageSize))
+	c.Check(t.fs.usedBytes, Equals, uint64(4*pageSize))
+
+	// More than there is room for.
+	c.Check(t.fallocate(handle, 0, 0, 20*pageSize), Equals, syscall.ENOSPC)
+	c.Check(t.fs.usedBytes, Equals, uint64(4*pageSize))
+
+	// Shrinking drops the preallocated pages past the end.
+	t.truncate(c, file, pageSize)
+	c.Check(t.fs.usedBytes, Equals, uint64(pageSize))
+}
+
+func (t *FileSystemTest) TestFallocatePunchHole(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+	t.write(c, handle, 0, strings.Repeat("x", 3*pageSize))
+
+	// Punching a hole must keep the size.
+	c.Check(
+		t.fallocate(handle, unix.FALLOC_FL_PUNCH_HOLE, 0, pageSize),
+		Equals,
+		syscall.EOPNOTSUPP)
+
+	// The page wholly within the hole is released, and the rest zeroed.
+	mode := uint32(unix.FALLOC_FL_PUNCH_HOLE | unix.FALLOC_FL_KEEP_SIZE)
+	c.Assert(t.fallocate(handle, mode, 10, 2*pageSize), IsNil)
+	c.Check(t.fs.usedBytes, Equals, uint64(2*pageSize))
+	c.Check(
+		t.read(c, handle, 0, 3*pageSize),
+		Equals,
+		strings.Repeat("x", 10)+strings.Repeat("\x00", 2*pageSize)+strings.Repeat("x", pageSize-10))
+}
+
+func (t *FileSystemTest) TestFallocateZeroRange(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+	t.write(c, handle, 0, "taco")
+	t.write(c, handle, 2*pageSize, "burrito")
+
+	// The range is zeroed, and allocated throughout.
+	c.Assert(t.fallocate(handle, unix.FALLOC_FL_ZERO_RANGE, 0, 3*pageSize), IsNil)
+	c.Check(t.fs.usedBytes, Equals, uint64(3*pageSize))
+	c.Check(t.read(c, handle, 0, 3*pageSize), Equals, strings.Repeat("\x00", 3*pageSize))
+}
+
+func (t *FileSystemTest) TestFallocateJournaled(c *C) {
+	path := c.MkDir() + "/journal"
+	t.mountJournal(c, path)
+
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+	t.write(c, handle, 0, strings.Repeat("x", 2*pageSize))
+
+	mode := uint32(unix.FALLOC_FL_PUNCH_HOLE | unix.FALLOC_FL_KEEP_SIZE)
+	c.Assert(t.fallocate(handle, mode, 0, pageSize), IsNil)
+	c.Assert(t.fallocate(handle, unix.FALLOC_FL_KEEP_SIZE, 8*pageSize, pageSize), IsNil)
+	c.Assert(t.fallocate(handle, 0, 0, 4*pageSize), IsNil)
+	t.sync(c)
+
+	used, size := t.fs.usedBytes, t.fs.getInode(file).attrs.Size
+	t.mountJournal(c, path)
+	c.Check(t.fs.usedBytes, Equals, used)
+	c.Check(t.fs.getInode(file).attrs.Size, Equals, size)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Rename
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) TestRenameReplacesFile(c *C) {
+	path := c.MkDir() + "/journal"
+	t.mountJournal(c, path)
+
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	replaced := t.mkFile(c, fuseops.RootInodeID, "g")
+	err := t.fs.ForgetInode(t.ctx, &fuseops.ForgetInodeOp{Inode: replaced, N: 1})
+	c.Assert(err, IsNil)
+
+	before := time.Now()
+	c.Assert(t.rename(fuseops.RootInodeID, "f", fuseops.RootInodeID, "g"), IsNil)
+
+	// The replaced file is gone for good, and the renamed one has changed.
+	c.Check(t.fs.getInode(replaced), IsNil)
+	c.Check(t.fs.getInode(file).attrs.Ctime.Before(before), Equals, false)
+	c.Check(t.lookUp(c, fuseops.RootInodeID, "g"), Equals, file)
+
+	t.sync(c)
+	t.mountJournal(c, path)
+	c.Check(t.lookUp(c, fuseops.RootInodeID, "g"), Equals, file)
+	_, _, ok := t.fs.getInode(fuseops.RootInodeID).LookUpChild("f")
+	c.Check(ok, Equals, false)
+}
+
+func (t *FileSystemTest) TestRenameReplacesEmptyDirectory(c *C) {
+	t.mkDir(c, fuseops.RootInodeID, "a")
+	replaced := t.mkDir(c, fuseops.RootInodeID, "b")
+	c.Assert(t.rename(fuseops.RootInodeID, "a", fuseops.RootInodeID, "b"), IsNil)
+
+	// The replaced directory loses both its entry and its ".".
+	c.Check(t.fs.getInode(replaced).attrs.Nlink, Equals, uint32(0))
+	c.Check(t.fs.getInode(fuseops.RootInodeID).attrs.Nlink, Equals, uint32(3))
+}
+
+func (t *FileSystemTest) TestRenameOverNonEmptyDirectory(c *C) {
+	t.mkDir(c, fuseops.RootInodeID, "a")
+	b := t.mkDir(c, fuseops.RootInodeID, "b")
+	t.mkFile(c, b, "f")
+
+	err := t.rename(fuseops.RootInodeID, "a", fuseops.RootInodeID, "b")
+	c.Check(err, Equals, syscall.ENOTEMPTY)
+}
+
+func (t *FileSystemTest) TestRenameOverAncestor(c *C) {
+	a := t.mkDir(c, fuseops.RootInodeID, "a")
+	t.mkDir(c, a, "b")
+
+	err := t.rename(a, "b", fuseops.RootInodeID, "a")
+	c.Check(err, Equals, syscall.ENOTEMPTY)
+}
+
+func (t *FileSystemTest) TestRenameOverHardLinkToSelf(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	err := t.fs.CreateLink(t.ctx, &fuseops.CreateLinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "g",
+		Target: file,
+	})
+
+	c.Assert(err, IsNil)
+
+	// Both names refer to the same file, so nothing happens.
+	c.Assert(t.rename(fuseops.RootInodeID, "f", fuseops.RootInodeID, "g"), IsNil)
+	c.Check(t.lookUp(c, fuseops.RootInodeID, "f"), Equals, file)
+	c.Check(t.lookUp(c, fuseops.RootInodeID, "g"), Equals, file)
+	c.Check(t.fs.getInode(file).attrs.Nlink, Equals, uint32(2))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Directory links
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) TestDirectoryLinkCounts(c *C) {
+	nlink := func(id fuseops.InodeID) uint32 {
+		return t.fs.getInode(id).attrs.Nlink
+	}
+
+	// Each directory is linked from its parent and its own ".", and links to
+	// its parent through "..".
+	a := t.mkDir(c, fuseops.RootInodeID, "a")
+	b := t.mkDir(c, fuseops.RootInodeID, "b")
+	sub := t.mkDir(c, a, "sub")
+	t.mkFile(c, a, "f")
+	c.Check(nlink(fuseops.RootInodeID), Equals, uint32(4))
+	c.Check(nlink(a), Equals, uint32(3))
+	c.Check(nlink(sub), Equals, uint32(2))
+
+	// Moving a directory moves its ".." link.
+	c.Assert(t.rename(a, "sub", b, "sub"), IsNil)
+	c.Check(nlink(a), Equals, uint32(2))
+	c.Check(nlink(b), Equals, uint32(3))
+	c.Check(t.fs.getInode(sub).parentID(), Equals, b)
+
+	// Removing it takes its links away with it.
+	err := t.fs.RmDir(t.ctx, &fuseops.RmDirOp{Parent: b, Name: "sub"})
+	c.Assert(err, IsNil)
+	c.Check(nlink(b), Equals, uint32(2))
+	c.Check(nlink(sub), Equals, uint32(0))
+}
+
+func (t *FileSystemTest) TestReadDirListsDots(c *C) {
+	dir := t.mkDir(c, fuseops.RootInodeID, "dir")
+
+	// Entries for "." and ".." take 32 bytes each, and come at offsets 1 and
+	// 2.
+	c.Check(t.readDir(c, dir, 0), Equals, 64)
+	c.Check(t.readDir(c, dir, 1), Equals, 32)
+	c.Check(t.readDir(c, dir, 2), Equals, 0)
+
+	t.mkFile(c, dir, "f")
+	c.Check(t.readDir(c, dir, 2), Equals, 32)
+}
+
+func (t *FileSystemTest) TestReadDirOfRemovedDirectory(c *C) {
+	dir := t.mkDir(c, fuseops.RootInodeID, "dir")
+	open := &fuseops.OpenDirOp{Inode: dir}
+	c.Assert(t.fs.OpenDir(t.ctx, open), IsNil)
+
+	err := t.fs.RmDir(t.ctx, &fuseops.RmDirOp{Parent: fuseops.RootInodeID, Name: "dir"})
+	c.Assert(err, IsNil)
+
+	// Not even "." and ".." are left.
+	op := &fuseops.ReadDirOp{
+		Inode:  dir,
+		Handle: open.Handle,
+		Dst:    make([]byte, 4096),
+	}
+
+	c.Assert(t.fs.ReadDir(t.ctx, op), IsNil)
+	c.Check(op.BytesRead, Equals, 0)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Kernel caching
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) TestLookUpMissingWithoutNegativeTimeout(c *C) {
+	err := t.fs.LookUpInode(t.ctx, &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "missing",
+	})
+
+	c.Assert(err, Equals, syscall.ENOENT)
+}
+
+func (t *FileSystemTest) TestLookUpMissingWithNegativeTimeout(c *C) {
+	t.fs.negativeTimeout = time.Minute
+	op := &fuseops.LookUpInodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "missing",
+	}
+
+	c.Assert(t.fs.LookUpInode(t.ctx, op), IsNil)
+	c.Check(op.Entry.Child, Equals, fuseops.InodeID(0))
+	c.Check(op.Entry.EntryExpiration.After(time.Now()), Equals, true)
+}
+
+func (t *FileSystemTest) TestEntryExpirations(c *C) {
+	t.fs.attrTimeout = time.Minute
+	t.fs.entryTimeout = time.Hour
+	op := &fuseops.MkDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "dir",
+		Mode:   os.ModeDir | 0755,
+	}
+
+	c.Assert(t.fs.MkDir(t.ctx, op), IsNil)
+	c.Check(op.Entry.AttributesExpiration.After(time.Now()), Equals, true)
+	c.Check(op.Entry.EntryExpiration.After(op.Entry.AttributesExpiration), Equals, true)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Writeback caching
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) TestFlushUnknownHandle(c *C) {
+	err := t.fs.FlushFile(t.ctx, &fuseops.FlushFileOp{
+		Handle: 1000,
+	})
+
+	c.Assert(err, Equals, syscall.EBADF)
+}
+
+func (t *FileSystemTest) TestReadWriteOnlyWithoutWritebackCache(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_WRONLY)
+
+	err := t.fs.ReadFile(t.ctx, &fuseops.ReadFileOp{
+		Inode:  file,
+		Handle: handle,
+		Dst:    make([]byte, 1),
+	})
+
+	c.Assert(err, Equals, syscall.EBADF)
+}
+
+func (t *FileSystemTest) TestReadWriteOnlyWithWritebackCache(c *C) {
+	t.fs.writebackCache = true
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_WRONLY)
+
+	err := t.fs.ReadFile(t.ctx, &fuseops.ReadFileOp{
+		Inode:  file,
+		Handle: handle,
+		Dst:    make([]byte, 1),
+	})
+
+	c.Assert(err, IsNil)
+}
+
+func (t *FileSystemTest) TestAppendWithWritebackCache(c *C) {
+	t.fs.writebackCache = true
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_WRONLY|syscall.O_APPEND)
+
+	// The kernel works out where appends go, and may write back pages
+	// in any order.
+	for _, off := range []int64{4, 0} {
+		err := t.fs.WriteFile(t.ctx, &fuseops.WriteFileOp{
+			Inode:  file,
+			Handle: handle,
+			Offset: off,
+			Data:   []byte("abcd"),
+		})
+
+		c.Assert(err, IsNil)
+	}
+
+	c.Check(t.fs.getInode(file).attrs.Size, Equals, uint64(8))
+	c.Check(
+		t.fs.ReleaseFileHandle(t.ctx, &fuseops.ReleaseFileHandleOp{Handle: handle}),
+		IsNil)
+}
+
+func (t *FileSystemTest) TestReleaseAfterJournalFailure(c *C) {
+	t.fs.writebackCache = true
+	t.fs.journal = &journal{err: errors.New("taco")}
+
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+
+	err := t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "f",
+	})
+
+	c.Assert(err, IsNil)
+	err = t.fs.ForgetInode(t.ctx, &fuseops.ForgetInodeOp{Inode: file, N: 1})
+	c.Assert(err, IsNil)
+
+	// The failure is reported, but the handle and the file are gone anyway.
+	err = t.fs.ReleaseFileHandle(t.ctx, &fuseops.ReleaseFileHandleOp{Handle: handle})
+	c.Check(err, Equals, syscall.EIO)
+	c.Check(t.fs.getInode(file), IsNil)
+
+	err = t.fs.ReleaseFileHandle(t.ctx, &fuseops.ReleaseFileHandleOp{Handle: handle})
+	c.Check(err, Equals, syscall.EBADF)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Vectored reads
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) TestVectoredRead(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+	t.write(c, handle, 0, "taco")
+	t.write(c, handle, 2*pageSize, "burrito")
+
+	op := &fuseops.ReadFileOp{
+		Inode:  file,
+		Handle: handle,
+		Offset: 2,
+		Size:   3 * pageSize,
+	}
+
+	c.Assert(t.fs.ReadFile(t.ctx, op), IsNil)
+	c.Assert(op.BytesRead, Equals, 2*pageSize+5)
+
+	// The hole in the middle reads as zeros.
+	var data []byte
+	for _, d := range op.Data {
+		data = append(data, d...)
+	}
+
+	c.Check(string(data[:2]), Equals, "co")
+	c.Check(data[2:2*pageSize-2], DeepEquals, make([]byte, 2*pageSize-4))
+	c.Check(string(data[2*pageSize-2:]), Equals, "burrito")
+}
+
+func (t *FileSystemTest) TestVectoredReadOutlivesChanges(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+	t.write(c, handle, 0, "taco")
+
+	op := &fuseops.ReadFileOp{
+		Inode:  file,
+		Handle: handle,
+		Size:   pageSize,
+	}
+
+	c.Assert(t.fs.ReadFile(t.ctx, op), IsNil)
+	c.Assert(op.Data, HasLen, 1)
+
+	// Neither writing nor truncating may touch the pages being replied with.
+	t.write(c, handle, 0, "enchilada")
+	size := uint64(1)
+	err := t.fs.SetInodeAttributes(t.ctx, &fuseops.SetInodeAttributesOp{
+		Inode: file,
+		Size:  &size,
+	})
+
+	c.Assert(err, IsNil)
+	c.Check(string(op.Data[0]), Equals, "taco")
+	c.Check(t.fs.getInode(file).contents.allocated(), Equals, uint64(pageSize))
+}
+
+////////////////////////////////////////////////////////////////////////
+// Benchmarks
+////////////////////////////////////////////////////////////////////////
+
+// Read a large file sequentially, the way the kernel does for a large read,
+// either copying into a buffer or replying with the pages themselves. If
+// rewrite is set, each read is followed by a write of the same range.
+//
+// Pages replied with stay marked as lent until they are next modified, since
+// there's no telling when the kernel has finished with them. So a vectored
+// read makes the next write to each of its pages copy the page first, and
+// the rewriting benchmarks measure that cost.
+func benchmarkSequentialRead(b *testing.B, vectored bool, rewrite bool) {
+	const fileSize = 64 << 20
+	const readSize = 128 << 10
+
+	ctx := context.Background()
+	server, err := NewServer(&ServerConfig{FilePerms: 0644, DirPerms: 0755})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	fs := server.fs
+	create := &fuseops.CreateFileOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "f",
+		Mode:   0644,
+	}
+
+	if err := fs.CreateFile(ctx, create); err != nil {
+		b.Fatal(err)
+	}
+
+	chunk := make([]byte, readSize)
+	for i := range chunk {
+		chunk[i] = byte(i)
+	}
+
+	for off := int64(0); off < fileSize; off += readSize {
+		err := fs.WriteFile(ctx, &fuseops.WriteFileOp{
+			Handle: create.Handle,
+			Offset: off,
+			Data:   chunk,
+		})
+
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var dst []byte
+	if !vectored {
+		dst = make([]byte, readSize)
+	}
+
+	b.SetBytes(readSize)
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		op := &fuseops.ReadFileOp{
+			Inode:  create.Entry.Child,
+			Handle: create.Handle,
+			Offset: int64(i) * readSize % fileSize,
+			Size:   readSize,
+			Dst:    dst,
+		}
+
+		if err := fs.ReadFile(ctx, op); err != nil {
+			b.Fatal(err)
+		}
+
+		if !rewrite {
+			continue
+		}
+
+		err := fs.WriteFile(ctx, &fuseops.WriteFileOp{
+			Handle: create.Handle,
+			Offset: op.Offset,
+			Data:   chunk,
+		})
+
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadFileCopy(b *testing.B) {
+	benchmarkSequentialRead(b, false, false)
+}
+
+func BenchmarkReadFileVectored(b *testing.B) {
+	benchmarkSequentialRead(b, true, false)
+}
+
+func BenchmarkReadWriteFileCopy(b *testing.B) {
+	benchmarkSequentialRead(b, false, true)
+}
+
+func BenchmarkReadWriteFileVectored(b *testing.B) {
+	benchmarkSequentialRead(b, true, true)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Permissions
+////////////////////////////////////////////////////////////////////////
+
+// Callers other than root. Only the primary group counts for them, since they
+// have no process to read supplementary groups from.
+var (
+	ownerCtx    = fuseops.OpContext{Uid: 1000, Gid: 1000}
+	memberCtx   = fuseops.OpContext{Uid: 1001, Gid: 2000}
+	strangerCtx = fuseops.OpContext{Uid: 1002, Gid: 1002}
+)
+
+// Make a directory anyone may create entries in.
+func (t *FileSystemTest) mkSharedDir(c *C) fuseops.InodeID {
+	op := &fuseops.MkDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "shared",
+		Mode:   os.ModeDir | 0777,
+	}
+
+	c.Assert(t.fs.MkDir(t.ctx, op), IsNil)
+	return op.Entry.Child
+}
+
+// Make a file with the given mode owned by ownerCtx's user and by group 2000.
+func (t *FileSystemTest) mkOwnedFile(c *C, mode os.FileMode) fuseops.InodeID {
+	op := &fuseops.MkNodeOp{
+		Parent:    t.mkSharedDir(c),
+		Name:      "f",
+		Mode:      mode,
+		OpContext: ownerCtx,
+	}
+
+	c.Assert(t.fs.MkNode(t.ctx, op), IsNil)
+
+	gid := memberCtx.Gid
+	err := t.fs.SetInodeAttributes(t.ctx, &fuseops.SetInodeAttributesOp{
+		Inode: op.Entry.Child,
+		Gid:   &gid,
+	})
+
+	c.Assert(err, IsNil)
+	return op.Entry.Child
+}
+
+func (t *FileSystemTest) openAs(
+	opCtx fuseops.OpContext,
+	inode fuseops.InodeID,
+	flags fuseops.OpenFlags) error {
+	return t.fs.OpenFile(t.ctx, &fuseops.OpenFileOp{
+		Inode:     inode,
+		OpenFlags: flags,
+		OpContext: opCtx,
+	})
+}
+
+func (t *FileSystemTest) TestAccessOwnerOnly(c *C) {
+	file := t.mkOwnedFile(c, 0600)
+
+	c.Check(t.openAs(ownerCtx, file, syscall.O_RDWR), IsNil)
+	c.Check(t.openAs(memberCtx, file, syscall.O_RDONLY), Equals, syscall.EACCES)
+	c.Check(t.openAs(strangerCtx, file, syscall.O_RDONLY), Equals, syscall.EACCES)
+
+	// Root may open anything.
+	c.Check(t.openAs(fuseops.OpContext{}, file, syscall.O_RDWR), IsNil)
+}
+
+func (t *FileSystemTest) TestAccessGroup(c *C) {
+	file := t.mkOwnedFile(c, 0640)
+
+	c.Check(t.openAs(memberCtx, file, syscall.O_RDONLY), IsNil)
+	c.Check(t.openAs(memberCtx, file, syscall.O_WRONLY), Equals, syscall.EACCES)
+	c.Check(t.openAs(strangerCtx, file, syscall.O_RDONLY), Equals, syscall.EACCES)
+
+	// Truncating on open needs write permission too.
+	err := t.openAs(memberCtx, file, syscall.O_RDONLY|syscall.O_TRUNC)
+	c.Check(err, Equals, syscall.EACCES)
+}
+
+func (t *FileSystemTest) TestAccessGroupDeniesWhatOthersGet(c *C) {
+	file := t.mkOwnedFile(c, 0604)
+
+	// Only the class the caller falls into counts.
+	c.Check(t.openAs(ownerCtx, file, syscall.O_RDONLY), IsNil)
+	c.Check(t.openAs(memberCtx, file, syscall.O_RDONLY), Equals, syscall.EACCES)
+	c.Check(t.openAs(strangerCtx, file, syscall.O_RDONLY), IsNil)
+}
+
+func (t *FileSystemTest) TestAccessDirectory(c *C) {
+	mkDir := &fuseops.MkDirOp{
+		Parent:    t.mkSharedDir(c),
+		Name:      "dir",
+		Mode:      os.ModeDir | 0700,
+		OpContext: ownerCtx,
+	}
+
+	c.Assert(t.fs.MkDir(t.ctx, mkDir), IsNil)
+	dir := mkDir.Entry.Child
+
+	mkNode := &fuseops.MkNodeOp{
+		Parent:    dir,
+		Name:      "f",
+		Mode:      0644,
+		OpContext: ownerCtx,
+	}
+
+	c.Assert(t.fs.MkNode(t.ctx, mkNode), IsNil)
+
+	lookUp := func(opCtx fuseops.OpContext) error {
+		return t.fs.LookUpInode(t.ctx, &fuseops.LookUpInodeOp{
+			Parent:    dir,
+			Name:      "f",
+			OpContext: opCtx,
+		})
+	}
+
+	openDir := func(opCtx fuseops.OpContext) error {
+		return t.fs.OpenDir(t.ctx, &fuseops.OpenDirOp{
+			Inode:     dir,
+			OpContext: opCtx,
+		})
+	}
+
+	create := func(opCtx fuseops.OpContext) error {
+		return t.fs.MkNode(t.ctx, &fuseops.MkNodeOp{
+			Parent:    dir,
+			Name:      "g",
+			Mode:      0644,
+			OpContext: opCtx,
+		})
+	}
+
+	// Without search permission, nothing in the directory can be found.
+	c.Check(lookUp(strangerCtx), Equals, syscall.EACCES)
+	c.Check(openDir(strangerCtx), Equals, syscall.EACCES)
+
+	// Search permission alone allows lookups, but not listing or creating.
+	mode := os.ModeDir | 0711
+	err := t.fs.SetInodeAttributes(t.ctx, &fuseops.SetInodeAttributesOp{
+		Inode:     dir,
+		Mode:      &mode,
+		OpContext: ownerCtx,
+	})
+
+	c.Assert(err, IsNil)
+	c.Check(lookUp(strangerCtx), IsNil)
+	c.Check(openDir(strangerCtx), Equals, syscall.EACCES)
+	c.Check(create(strangerCtx), Equals, syscall.EACCES)
+	c.Check(create(ownerCtx), IsNil)
+}
+
+func (t *FileSystemTest) chown(
+	opCtx fuseops.OpContext,
+	inode fuseops.InodeID,
+	uid *uint32,
+	gid *uint32) error {
+	return t.fs.SetInodeAttributes(t.ctx, &fuseops.SetInodeAttributesOp{
+		Inode:     inode,
+		Uid:       uid,
+		Gid:       gid,
+		OpContext: opCtx,
+	})
+}
+
+func (t *FileSystemTest) chmod(
+	opCtx fuseops.OpContext,
+	inode fuseops.InodeID,
+	mode os.FileMode) error {
+	return t.fs.SetInodeAttributes(t.ctx, &fuseops.SetInodeAttributesOp{
+		Inode:     inode,
+		Mode:      &mode,
+		OpContext: opCtx,
+	})
+}
+
+func (t *FileSystemTest) TestChownOwner(c *C) {
+	file := t.mkOwnedFile(c, 0644)
+	same, other := ownerCtx.Uid, strangerCtx.Uid
+
+	// Only root may give a file away, though the owner may keep it.
+	c.Check(t.chown(ownerCtx, file, &other, nil), Equals, syscall.EPERM)
+	c.Check(t.chown(ownerCtx, file, &same, nil), IsNil)
+	c.Check(t.chown(fuseops.OpContext{}, file, &other, nil), IsNil)
+	c.Check(t.fs.getInode(file).attrs.Uid, Equals, other)
+}
+
+func (t *FileSystemTest) TestChownGroup(c *C) {
+	file := t.mkOwnedFile(c, 0644)
+	own, member := ownerCtx.Gid, memberCtx.Gid
+
+	// The owner may change the group to one they are a member of.
+	c.Check(t.chown(ownerCtx, file, nil, &own), IsNil)
+	c.Check(t.fs.getInode(file).attrs.Gid, Equals, own)
+	c.Check(t.chown(ownerCtx, file, nil, &member), Equals, syscall.EPERM)
+
+	// Nobody else may, even to their own group.
+	c.Check(t.chown(memberCtx, file, nil, &member), Equals, syscall.EPERM)
+	c.Check(t.fs.getInode(file).attrs.Gid, Equals, own)
+}
+
+func (t *FileSystemTest) TestChmod(c *C) {
+	file := t.mkOwnedFile(c, 0644)
+
+	c.Check(t.chmod(strangerCtx, file, 0777), Equals, syscall.EPERM)
+	c.Check(t.chmod(ownerCtx, file, 0600), IsNil)
+	c.Check(t.fs.getInode(file).attrs.Mode, Equals, os.FileMode(0600))
+}
+
+func (t *FileSystemTest) TestChmodSetgidOutsideGroup(c *C) {
+	file := t.mkOwnedFile(c, 0644)
+	mode := func() os.FileMode { return t.fs.getInode(file).attrs.Mode }
+
+	// The file's group is one the owner isn't a member of, so the bit is
+	// dropped.
+	c.Assert(t.chmod(ownerCtx, file, os.ModeSetgid|0755), IsNil)
+	c.Check(mode(), Equals, os.FileMode(0755))
+
+	// It stays for a member of the group, and for root.
+	ownerInGroup := fuseops.OpContext{Uid: ownerCtx.Uid, Gid: memberCtx.Gid}
+	c.Assert(t.chmod(ownerInGroup, file, os.ModeSetgid|0755), IsNil)
+	c.Check(mode(), Equals, os.ModeSetgid|0755)
+
+	c.Assert(t.chmod(fuseops.OpContext{}, file, os.ModeSetgid|0700), IsNil)
+	c.Check(mode(), Equals, os.ModeSetgid|0700)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Access times
+////////////////////////////////////////////////////////////////////////
+
+// Make a file, open it for reading and give it the given access time and a
+// modification and change time of mtime.
+func (t *FileSystemTest) mkReadFile(
+	c *C,
+	atime time.Time,
+	mtime time.Time) (fuseops.InodeID, fuseops.HandleID) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+	t.write(c, handle, 0, "taco")
+
+	in := t.fs.getInode(file)
+	in.attrs.Atime = atime
+	in.attrs.Mtime = mtime
+	in.attrs.Ctime = mtime
+
+	return file, handle
+}
+
+func (t *FileSystemTest) TestAtimeStrict(c *C) {
+	t.fs.atimeMode = AtimeStrict
+	hourAgo := time.Now().Add(-time.Hour)
+	file, handle := t.mkReadFile(c, hourAgo, hourAgo.Add(-time.Hour))
+
+	// Every read counts.
+	before := time.Now()
+	t.read(c, handle, 0, 4)
+	c.Check(t.fs.getInode(file).attrs.Atime.Before(before), Equals, false)
+
+	t.fs.getInode(file).attrs.Atime = hourAgo
+	t.read(c, handle, 0, 4)
+	c.Check(t.fs.getInode(file).attrs.Atime.Before(before), Equals, false)
+}
+
+func (t *FileSystemTest) TestAtimeNever(c *C) {
+	t.fs.atimeMode = AtimeNever
+	longAgo := time.Now().Add(-48 * time.Hour)
+	file, handle := t.mkReadFile(c, longAgo, time.Now())
+
+	// Not even a stale access time older than the last change is updated.
+	t.read(c, handle, 0, 4)
+	c.Check(t.fs.getInode(file).attrs.Atime.Equal(longAgo), Equals, true)
+}
+
+func (t *FileSystemTest) TestAtimeRelative(c *C) {
+	t.fs.atimeMode = AtimeRelative
+	hourAgo := time.Now().Add(-time.Hour)
+	file, handle := t.mkReadFile(c, hourAgo, hourAgo.Add(-time.Hour))
+	in := t.fs.getInode(file)
+
+	// Read since the last change, and recently.
+	t.read(c, handle, 0, 4)
+	c.Check(in.attrs.Atime.Equal(hourAgo), Equals, true)
+
+	// Changed since the last read.
+	in.attrs.Mtime = time.Now()
+	before := time.Now()
+	t.read(c, handle, 0, 4)
+	c.Check(in.attrs.Atime.Before(before), Equals, false)
+
+	// Not changed, but last read over a day ago.
+	dayAgo := time.Now().Add(-25 * time.Hour)
+	in.attrs.Atime = dayAgo
+	in.attrs.Mtime = dayAgo.Add(-time.Hour)
+	in.attrs.Ctime = dayAgo.Add(-time.Hour)
+	before = time.Now()
+	t.read(c, handle, 0, 4)
+	c.Check(in.attrs.Atime.Before(before), Equals, false)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Sticky directories
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) mkStickyDir(c *C) fuseops.InodeID {
+	op := &fuseops.MkDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "tmp",
+		Mode:   os.ModeDir | os.ModeSticky | 0777,
+	}
+
+	c.Assert(t.fs.MkDir(t.ctx, op), IsNil)
+	return op.Entry.Child
+}
+
+func (t *FileSystemTest) TestStickyDirProtectsOthersFiles(c *C) {
+	dir := t.mkStickyDir(c)
+	t.mkFile(c, dir, "f")
+
+	err := t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{
+		Parent:    dir,
+		Name:      "f",
+		OpContext: fuseops.OpContext{Uid: 1000, Gid: 1000},
+	})
+
+	c.Assert(err, Equals, syscall.EPERM)
+
+	err = t.fs.Rename(t.ctx, &fuseops.RenameOp{
+		OldParent: dir,
+		OldName:   "f",
+		NewParent: dir,
+		NewName:   "g",
+		OpContext: fuseops.OpContext{Uid: 1000, Gid: 1000},
+	})
+
+	c.Assert(err, Equals, syscall.EPERM)
+}
+
+func (t *FileSystemTest) TestStickyDirAllowsOwnFiles(c *C) {
+	dir := t.mkStickyDir(c)
+	opCtx := fuseops.OpContext{Uid: 1000, Gid: 1000}
+
+	create := &fuseops.MkNodeOp{
+		Parent:    dir,
+		Name:      "f",
+		Mode:      0644,
+		OpContext: opCtx,
+	}
+
+	c.Assert(t.fs.MkNode(t.ctx, create), IsNil)
+
+	err := t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{
+		Parent:    dir,
+		Name:      "f",
+		OpContext: opCtx,
+	})
+
+	c.Assert(err, IsNil)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Read-only mode
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) TestReadOnlyRejectsChanges(c *C) {
+	file := t.mkFile(c, fuseops.RootInodeID, "f")
+	handle := t.openFile(c, file, syscall.O_RDWR)
+	server := &Server{fs: t.fs}
+	server.SetReadOnly(true)
+
+	err := t.fs.MkDir(t.ctx, &fuseops.MkDirOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "dir",
+		Mode:   os.ModeDir | 0755,
+	})
+
+	c.Check(err, Equals, syscall.EROFS)
+
+	err = t.fs.MkNode(t.ctx, &fuseops.MkNodeOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "fifo",
+		Mode:   os.ModeNamedPipe | 0644,
+	})
+
+	c.Check(err, Equals, syscall.EROFS)
+
+	err = t.fs.Unlink(t.ctx, &fuseops.UnlinkOp{
+		Parent: fuseops.RootInodeID,
+		Name:   "f",
+	})
+
+	c.Check(err, Equals, syscall.EROFS)
+
+	err = t.fs.WriteFile(t.ctx, &fuseops.WriteFileOp{
+		Handle: handle,
+		Data:   []byte("taco"),
+	})
+
+	c.Check(err, Equals, syscall.EROFS)
+
+	err = t.fs.OpenFile(t.ctx, &fuseops.OpenFileOp{
+		Inode:     file,
+		OpenFlags: syscall.O_WRONLY,
+	})
+
+	c.Check(err, Equals, syscall.EROFS)
+
+	// Reading is fine.
+	readHandle := t.openFile(c, file, syscall.O_RDONLY)
+	err = t.fs.ReadFile(t.ctx, &fuseops.ReadFileOp{
+		Inode:  file,
+		Handle: readHandle,
+		Dst:    make([]byte, 1),
+	})
+
+	c.Check(err, IsNil)
+}
+
+func (t *FileSystemTest) TestReadOnlyToggle(c *C) {
+	server := &Server{fs: t.fs}
+	server.SetReadOnly(true)
+	c.Check(server.ReadOnly(), Equals, true)
+
+	server.SetReadOnly(false)
+	c.Check(server.ReadOnly(), Equals, false)
+	t.mkDir(c, fuseops.RootInodeID, "dir")
+}
+
+////////////////////////////////////////////////////////////////////////
+// Seeding
+////////////////////////////////////////////////////////////////////////
+
+func (t *FileSystemTest) TestSeed(c *C) {
+	dir := c.MkDir()
+	mtime := time.Date(2015, 3, 14, 9, 26, 53, 0, time.UTC)
+
+	// A file with a hole between two pages of data.
+	contents := make([]byte, 3*pageSize)
+	copy(contents, "taco")
+	copy(contents[2*pageSize:], "burrito")
+	c.Assert(os.Mkdir(dir+"/sub", 0700), IsNil)
+	c.Assert(os.WriteFile(dir+"/sub/f", contents, 0600), IsNil)
+	c.Assert(os.Link(dir+"/sub/f", dir+"/link"), IsNil)
+	c.Assert(os.Symlink("sub/f", dir+"/symlink"), IsNil)
+	c.Assert(os.Chtimes(dir+"/sub/f", mtime, mtime), IsNil)
+	c.Assert(os.Chtimes(dir+"/sub", mtime, mtime), IsNil)
+
+	var copied, total int64
+	err := t.fs.seed(dir, func(n, of int64) {
+		copied, total = n, of
+	})
+
+	c.Assert(err, IsNil)
+	c.Check(copied, Equals, int64(len(contents)))
+	c.Check(total, Equals, int64(len(contents)))
+
+	t.fs.mu.Lock()
+	t.fs.checkInvariants()
+	t.fs.mu.Unlock()
+
+	// The directory.
+	sub := t.fs.getInode(t.lookUp(c, fuseops.RootInodeID, "sub"))
+	c.Check(sub.attrs.Mode, Equals, os.ModeDir|0700)
+	c.Check(sub.attrs.Nlink, Equals, uint32(2))
+	c.Check(sub.attrs.Mtime.Equal(mtime), Equals, true)
+
+	// The file, linked from two places.
+	id := t.lookUp(c, t.lookUp(c, fuseops.RootInodeID, "sub"), "f")
+	c.Check(t.lookUp(c, fuseops.RootInodeID, "link"), Equals, id)
+
+	f := t.fs.getInode(id)
+	c.Check(f.attrs.Mode, Equals, os.FileMode(0600))
+	c.Check(f.attrs.Nlink, Equals, uint32(2))
+	c.Check(f.attrs.Size, Equals, uint64(len(contents)))
+	c.Check(f.attrs.Mtime.Equal(mtime), Equals, true)
+	c.Check(f.contents.allocated(), Equals, uint64(2*pageSize))
+
+	buf := make([]byte, len(contents))
+	_, err = f.ReadAt(buf, 0)
+	c.Assert(err, IsNil)
+	c.Check(string(buf), Equals, string(contents))
+
+	// The symlink.
+	symlink := t.fs.getInode(t.lookUp(c, fuseops.RootInodeID, "symlink"))
+	c.Check(symlink.attrs.Mode&os.ModeSymlink, Equals, os.ModeSymlink)
+	c.Check(symlink.target, Equals, "sub/f")
+}
+
+func (t *FileSystemTest) TestSeedRoot(c *C) {
+	dir := c.MkDir()
+	mtime := time.Date(2015, 3, 14, 9, 26, 53, 0, time.UTC)
+	c.Assert(os.WriteFile(dir+"/f", []byte("taco"), 0644), IsNil)
+	c.Assert(os.Chmod(dir, 0750|os.ModeSetgid), IsNil)
+	c.Assert(os.Chtimes(dir, mtime, mtime), IsNil)
+
+	c.Assert(t.fs.seed(dir, nil), IsNil)
+
+	root := t.fs.getInode(fuseops.RootInodeID)
+	c.Check(root.attrs.Mode, Equals, os.ModeDir|os.ModeSetgid|0750)
+	c.Check(root.attrs.Uid, Equals, uint32(os.Getuid()))
+	c.Check(root.attrs.Nlink, Equals, uint32(2))
+	c.Check(root.attrs.Mtime.Equal(mtime), Equals, true)
+}
+
+func (t *FileSystemTest) TestSeedXattrs(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.WriteFile(dir+"/f", []byte("taco"), 0644), IsNil)
+
+	err := syscall.Setxattr(dir+"/f", "user.foo", []byte("bar"), 0)
+	if err == syscall.ENOTSUP || err == syscall.EPERM {
+		c.Skip("extended attributes not supported by the host")
+	}
+
+	c.Assert(err, IsNil)
+	c.Assert(t.fs.seed(dir, nil), IsNil)
+
+	f := t.fs.getInode(t.lookUp(c, fuseops.RootInodeID, "f"))
+	c.Check(string(f.xattrs["user.foo"]), Equals, "bar")
+}
+
+func (t *FileSystemTest) TestSeedExisting(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.WriteFile(dir+"/f", []byte("taco"), 0644), IsNil)
+	t.mkFile(c, fuseops.RootInodeID, "f")
+
+	err := t.fs.seed(dir, nil)
+	c.Check(err, ErrorMatches, `Copying .*/f: "f" already exists`)
+}
+
+func (t *FileSystemTest) TestSeedSizeLimit(c *C) {
+	dir := c.MkDir()
+	c.Assert(os.WriteFile(dir+"/f", []byte(strings.Repeat("x", 2*pageSize)), 0644), IsNil)
+	t.fs.sizeLimit = pageSize
+
+	err := t.fs.seed(dir, nil)
+	c.Check(err, ErrorMatches, `Copying .*/f: no space left on device`)
+	c.Check(t.fs.usedBytes, Equals, uint64(0))
+}
@@ -0,0 +1,201 @@
+package filesystem
+
+import (
+	"fmt"
+	"syscall"
+
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// An open file, as returned by OpenFile or CreateFile.
+type fileHandle struct {
+	// The inode the handle refers to. The inode is kept alive by the handle,
+	// even once it has been unlinked and forgotten by the kernel.
+	id fuseops.InodeID
+	in *inode
+
+	// The flags the file was opened with.
+	flags fuseops.OpenFlags
+}
+
+func (h *fileHandle) readable() bool {
+	return int(h.flags)&syscall.O_ACCMODE != syscall.O_WRONLY
+}
+
+func (h *fileHandle) writable() bool {
+	return int(h.flags)&syscall.O_ACCMODE != syscall.O_RDONLY
+}
+
+func (h *fileHandle) appending() bool {
+	return int(h.flags)&syscall.O_APPEND != 0
+}
+
+// An open directory, as returned by OpenDir.
+type dirHandle struct {
+	id fuseops.InodeID
+	in *inode
+}
+
+////////////////////////////////////////////////////////////////////////
+// Handle table
+////////////////////////////////////////////////////////////////////////
+
+// Mint a new handle ID.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) nextHandleID() fuseops.HandleID {
+	fs.lastHandle++
+	return fs.lastHandle
+}
+
+// Open the given file, which the caller must have checked is a file.
+//
+// LOCKS_REQUIRED(in.mu)
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) openFile(
+	id fuseops.InodeID,
+	in *inode,
+	flags fuseops.OpenFlags) (handle fuseops.HandleID) {
+	in.openCount++
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// With writeback caching the kernel reads in the rest of a page before
+	// writing part of it, even through a handle opened only for writing, and
+	// works out where appends go itself. The caller has already checked that
+	// the original flags are allowed.
+	if fs.writebackCache {
+		if int(flags)&syscall.O_ACCMODE == syscall.O_WRONLY {
+			flags = flags&^syscall.O_ACCMODE | syscall.O_RDWR
+		}
+
+		flags &^= syscall.O_APPEND
+	}
+
+	handle = fs.nextHandleID()
+	fs.fileHandles[handle] = &fileHandle{
+		id:    id,
+		in:    in,
+		flags: flags,
+	}
+
+	fs.updateCounts()
+
+	return
+}
+
+// Open the given directory, which the caller must have checked is a
+// directory.
+//
+// LOCKS_REQUIRED(in.mu)
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) openDir(
+	id fuseops.InodeID,
+	in *inode) (handle fuseops.HandleID) {
+	in.openCount++
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	handle = fs.nextHandleID()
+	fs.dirHandles[handle] = &dirHandle{
+		id: id,
+		in: in,
+	}
+
+	fs.updateCounts()
+
+	return
+}
+
+// Find the given file handle. Return EBADF if it isn't open.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) getFileHandle(
+	handle fuseops.HandleID) (h *fileHandle, err error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	h, ok := fs.fileHandles[handle]
+	if !ok {
+		err = syscall.EBADF
+	}
+
+	return
+}
+
+// Find the given directory handle. Return EBADF if it isn't open.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) getDirHandle(
+	handle fuseops.HandleID) (h *dirHandle, err error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	h, ok := fs.dirHandles[handle]
+	if !ok {
+		err = syscall.EBADF
+	}
+
+	return
+}
+
+// Close the given handle, freeing its inode if that was the last thing
+// referring to it.
+//
+// LOCKS_EXCLUDED(fs.mu)
+func (fs *fileSystem) releaseHandle(
+	handle fuseops.HandleID,
+	dir bool) (err error) {
+	// Take the handle out of the table.
+	fs.mu.Lock()
+
+	var id fuseops.InodeID
+	var in *inode
+	if dir {
+		if h, ok := fs.dirHandles[handle]; ok {
+			id, in = h.id, h.in
+			delete(fs.dirHandles, handle)
+		}
+	} else {
+		if h, ok := fs.fileHandles[handle]; ok {
+			id, in = h.id, h.in
+			delete(fs.fileHandles, handle)
+		}
+	}
+
+	fs.updateCounts()
+	fs.mu.Unlock()
+
+	if in == nil {
+		err = syscall.EBADF
+		return
+	}
+
+	// Drop its reference to the inode.
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.openCount--
+	fs.maybeDeallocateInode(id, in)
+
+	return
+}
+
+// Check that every open handle refers to a live inode.
+//
+// LOCKS_REQUIRED(fs.mu)
+func (fs *fileSystem) checkHandleInvariants() {
+	for handle, h := range fs.fileHandles {
+		if fs.inodes[h.id] != h.in {
+			panic(fmt.Sprintf("File handle %v refers to dead inode %v", handle, h.id))
+		}
+	}
+
+	for handle, h := range fs.dirHandles {
+		if fs.inodes[h.id] != h.in {
+			panic(fmt.Sprintf("Dir handle %v refers to dead inode %v", handle, h.id))
+		}
+	}
+}
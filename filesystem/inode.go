@@ -4,44 +4,78 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/jacobsa/fuse/fuseops"
 	"github.com/jacobsa/fuse/fuseutil"
+	"github.com/jacobsa/syncutil"
 )
 
+// The mode bits that select the type of an inode.
+const inodeTypeBits = os.ModeDir |
+	os.ModeSymlink |
+	os.ModeNamedPipe |
+	os.ModeSocket |
+	os.ModeDevice |
+	os.ModeCharDevice
+
+// The setuid, setgid and sticky bits, which may accompany the permission bits.
+const inodeSpecialBits = os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
 // Common attributes for files and directories.
 //
-// External synchronization is required.
+// All mutable state is guarded by mu, except where noted.
 type inode struct {
 	/////////////////////////
 	// Mutable state
 	/////////////////////////
 
+	mu syncutil.InvariantMutex
+
 	// The current attributes of this inode.
 	//
-	// INVARIANT: attrs.Mode &^ (os.ModePerm|os.ModeDir|os.ModeSymlink) == 0
-	// INVARIANT: !(isDir() && isSymlink())
-	// INVARIANT: attrs.Size == len(contents)
+	// INVARIANT: attrs.Mode &^ (os.ModePerm|inodeSpecialBits|inodeTypeBits) == 0
+	// INVARIANT: direntType() != DT_Unknown
+	// INVARIANT: If !isFile(), attrs.Size == 0
+	// INVARIANT: If !isDevice(), attrs.Rdev == 0
+	// INVARIANT: If isDir(), attrs.Nlink is 2 plus the number of
+	// subdirectories, or 0 once the directory has been removed
 	attrs fuseops.InodeAttributes
 
-	// For directories, entries describing the children of the directory. Unused
-	// entries are of type DT_Unknown.
+	// For directories, entries describing the children of the directory, in
+	// the order they were added. Removed entries are of type DT_Unknown until
+	// the next compaction.
 	//
-	// This array can never be shortened, nor can its elements be moved, because
-	// we use its indices for Dirent.Offset, which is exposed to the user who
-	// might be calling readdir in a loop while concurrently modifying the
-	// directory. Unused entries can, however, be reused.
+	// Each entry's Offset is assigned when it is added and never changes, and
+	// is exposed to the user who might be calling readdir in a loop while
+	// concurrently modifying the directory. Since offsets only grow, a readdir
+	// that resumes after a given offset sees neither duplicates nor skipped
+	// entries, however much the slice has been compacted in the meantime.
 	//
 	// INVARIANT: If !isDir(), len(entries) == 0
-	// INVARIANT: For each i, entries[i].Offset == i+1
+	// INVARIANT: Offsets are strictly increasing, greater than dotDotOffset
+	// and less than nextOffset
 	// INVARIANT: Contains no duplicate names in used entries.
 	entries []fuseutil.Dirent
 
-	// For files, the current contents of the file.
+	// For directories, the index within entries of each used entry by name.
+	//
+	// INVARIANT: For each name n with index[n] == i, entries[i].Name == n and
+	// entries[i].Type != DT_Unknown
+	// INVARIANT: len(index) is the number of used entries
+	index map[string]int
+
+	// For directories, the offset to assign to the next entry added.
+	nextOffset fuseops.DirOffset
+
+	// For files, the current contents of the file, of length attrs.Size.
 	//
-	// INVARIANT: If !isFile(), len(contents) == 0
-	contents []byte
+	// INVARIANT: contents.checkInvariants(attrs.Size) does not panic
+	// INVARIANT: If !isFile(), contents.allocated() == 0
+	contents fileContents
 
 	// For symlinks, the target of the symlink.
 	//
@@ -50,8 +84,31 @@ type inode struct {
 
 	// extended attributes and values
 	xattrs map[string][]byte
+
+	// The number of lookups the kernel has made for this inode that it has not
+	// yet forgotten. An inode with no links is freed once this drops to zero.
+	lookupCount uint64
+
+	// The number of open file or directory handles referring to this inode. An
+	// inode with no links is kept alive while it is open, so that an unlinked
+	// file stays usable until it is closed.
+	openCount uint64
+
+	// For directories other than the root, the ID of the directory containing
+	// this one, or zero once it has been removed. Accessed atomically so that
+	// Rename can walk up the tree without taking any inode locks.
+	//
+	// INVARIANT: If !isDir(), parent == 0
+	parent fuseops.InodeID
 }
 
+// The offsets of the "." and ".." entries of every directory. Offsets of the
+// entries for children follow them.
+const (
+	dotOffset    fuseops.DirOffset = 1
+	dotDotOffset fuseops.DirOffset = 2
+)
+
 ////////////////////////////////////////////////////////////////////////
 // Helpers
 ////////////////////////////////////////////////////////////////////////
@@ -62,7 +119,9 @@ func newInode(
 	attrs fuseops.InodeAttributes) (in *inode) {
 	// Update time info.
 	now := time.Now()
+	attrs.Atime = now
 	attrs.Mtime = now
+	attrs.Ctime = now
 	attrs.Crtime = now
 
 	// Create the object.
@@ -71,36 +130,46 @@ func newInode(
 		xattrs: make(map[string][]byte),
 	}
 
+	in.mu = syncutil.NewInvariantMutex(invariantCheck(in.CheckInvariants))
+
 	return
 }
 
 func (in *inode) CheckInvariants() {
-	// INVARIANT: attrs.Mode &^ (os.ModePerm|os.ModeDir|os.ModeSymlink) == 0
-	if !(in.attrs.Mode&^(os.ModePerm|os.ModeDir|os.ModeSymlink) == 0) {
+	// INVARIANT: attrs.Mode &^ (os.ModePerm|inodeSpecialBits|inodeTypeBits) == 0
+	if !(in.attrs.Mode&^(os.ModePerm|inodeSpecialBits|inodeTypeBits) == 0) {
 		panic(fmt.Sprintf("Unexpected mode: %v", in.attrs.Mode))
 	}
 
-	// INVARIANT: !(isDir() && isSymlink())
-	if in.isDir() && in.isSymlink() {
+	// INVARIANT: direntType() != DT_Unknown
+	if in.direntType() == fuseutil.DT_Unknown {
 		panic(fmt.Sprintf("Unexpected mode: %v", in.attrs.Mode))
 	}
 
-	// INVARIANT: attrs.Size == len(contents)
-	if in.attrs.Size != uint64(len(in.contents)) {
-		panic(fmt.Sprintf(
-			"Size mismatch: %d vs. %d",
-			in.attrs.Size,
-			len(in.contents)))
+	// INVARIANT: If !isDevice(), attrs.Rdev == 0
+	if !in.isDevice() && in.attrs.Rdev != 0 {
+		panic(fmt.Sprintf("Unexpected rdev: %v", in.attrs.Rdev))
+	}
+
+	// INVARIANT: If !isFile(), attrs.Size == 0
+	if !in.isFile() && in.attrs.Size != 0 {
+		panic(fmt.Sprintf("Unexpected size: %d", in.attrs.Size))
 	}
 
+	// INVARIANT: contents.checkInvariants(attrs.Size) does not panic
+	in.contents.checkInvariants(in.attrs.Size)
+
 	// INVARIANT: If !isDir(), len(entries) == 0
 	if !in.isDir() && len(in.entries) != 0 {
 		panic(fmt.Sprintf("Unexpected entries length: %d", len(in.entries)))
 	}
 
-	// INVARIANT: For each i, entries[i].Offset == i+1
+	// INVARIANT: Offsets are strictly increasing, greater than dotDotOffset
+	// and less than nextOffset
 	for i, e := range in.entries {
-		if !(e.Offset == fuseops.DirOffset(i+1)) {
+		if (i > 0 && e.Offset <= in.entries[i-1].Offset) ||
+			e.Offset <= dotDotOffset ||
+			e.Offset >= in.nextOffset {
 			panic(fmt.Sprintf("Unexpected offset for index %d: %d", i, e.Offset))
 		}
 	}
@@ -117,9 +186,27 @@ func (in *inode) CheckInvariants() {
 		}
 	}
 
-	// INVARIANT: If !isFile(), len(contents) == 0
-	if !in.isFile() && len(in.contents) != 0 {
-		panic(fmt.Sprintf("Unexpected length: %d", len(in.contents)))
+	// INVARIANT: For each name n with index[n] == i, entries[i].Name == n and
+	// entries[i].Type != DT_Unknown
+	for name, i := range in.index {
+		if i < 0 || i >= len(in.entries) ||
+			in.entries[i].Name != name ||
+			in.entries[i].Type == fuseutil.DT_Unknown {
+			panic(fmt.Sprintf("Bad index for name %s: %d", name, i))
+		}
+	}
+
+	// INVARIANT: len(index) is the number of used entries
+	if len(in.index) != len(childNames) {
+		panic(fmt.Sprintf(
+			"Index length mismatch: %d vs. %d",
+			len(in.index),
+			len(childNames)))
+	}
+
+	// INVARIANT: If !isFile(), contents.allocated() == 0
+	if !in.isFile() && in.contents.allocated() != 0 {
+		panic(fmt.Sprintf("Unexpected contents: %d", in.contents.allocated()))
 	}
 
 	// INVARIANT: If !isSymlink(), len(target) == 0
@@ -127,6 +214,17 @@ func (in *inode) CheckInvariants() {
 		panic(fmt.Sprintf("Unexpected target length: %d", len(in.target)))
 	}
 
+	// INVARIANT: If !isDir(), parent == 0
+	if !in.isDir() && in.parentID() != 0 {
+		panic(fmt.Sprintf("Unexpected parent: %v", in.parentID()))
+	}
+
+	// INVARIANT: If isDir(), attrs.Nlink is 2 plus the number of
+	// subdirectories, or 0 once the directory has been removed
+	if in.isDir() && in.attrs.Nlink != 0 && in.attrs.Nlink != 2+in.subdirs() {
+		panic(fmt.Sprintf("Unexpected link count: %d", in.attrs.Nlink))
+	}
+
 	return
 }
 
@@ -138,27 +236,111 @@ func (in *inode) isSymlink() bool {
 	return in.attrs.Mode&os.ModeSymlink != 0
 }
 
+// Is the inode a regular file?
 func (in *inode) isFile() bool {
-	return !(in.isDir() || in.isSymlink())
+	return in.attrs.Mode&inodeTypeBits == 0
 }
 
-// Return the index of the child within in.entries, if it exists.
-//
-// REQUIRES: in.isDir()
+// Is the inode a character or block device?
+func (in *inode) isDevice() bool {
+	return in.attrs.Mode&os.ModeDevice != 0
+}
+
+// Return the type of directory entry that refers to the inode, or DT_Unknown
+// if the mode doesn't describe a supported type.
+func (in *inode) direntType() fuseutil.DirentType {
+	return direntTypeForMode(in.attrs.Mode)
+}
+
+func direntTypeForMode(mode os.FileMode) fuseutil.DirentType {
+	switch mode & inodeTypeBits {
+	case 0:
+		return fuseutil.DT_File
+	case os.ModeDir:
+		return fuseutil.DT_Directory
+	case os.ModeSymlink:
+		return fuseutil.DT_Link
+	case os.ModeNamedPipe:
+		return fuseutil.DT_FIFO
+	case os.ModeSocket:
+		return fuseutil.DT_Socket
+	case os.ModeDevice:
+		return fuseutil.DT_Block
+	case os.ModeDevice | os.ModeCharDevice:
+		return fuseutil.DT_Char
+	}
+
+	return fuseutil.DT_Unknown
+}
+
+// Is the inode still referenced by a directory entry, the kernel or an open
+// handle?
+func (in *inode) isReachable() bool {
+	return in.attrs.Nlink > 0 || in.lookupCount > 0 || in.openCount > 0
+}
+
+// Record a change to the contents of the inode, updating its modification and
+// change times.
+func (in *inode) touch() {
+	now := time.Now()
+	in.attrs.Mtime = now
+	in.attrs.Ctime = now
+}
+
+// Should a read at the given time update the access time, according to the
+// given mode?
+func (in *inode) atimeNeedsUpdate(mode AtimeMode, now time.Time) bool {
+	switch mode {
+	case AtimeNever:
+		return false
+
+	case AtimeStrict:
+		return true
+	}
+
+	// Like Linux's relatime, update the access time if the inode has changed
+	// since it was last read, or if the access time is at least a day old.
+	atime := in.attrs.Atime
+	return !atime.After(in.attrs.Mtime) ||
+		!atime.After(in.attrs.Ctime) ||
+		now.Sub(atime) >= 24*time.Hour
+}
+
+// Return the ID of the directory containing this one. See the parent field.
+func (in *inode) parentID() fuseops.InodeID {
+	return fuseops.InodeID(atomic.LoadUint64((*uint64)(&in.parent)))
+}
+
+// Record the directory containing this one. See the parent field.
+func (in *inode) setParentID(id fuseops.InodeID) {
+	atomic.StoreUint64((*uint64)(&in.parent), uint64(id))
+}
+
+// Return the index of the child within in.entries, if it exists. A
+// non-directory has no children.
 func (in *inode) findChild(name string) (i int, ok bool) {
-	if !in.isDir() {
-		panic("findChild called on non-directory.")
+	i, ok = in.index[name]
+	return
+}
+
+// Drop removed entries from in.entries once they make up at least half of it,
+// so that a directory that shrinks gives its memory back. Offsets are not
+// affected.
+func (in *inode) maybeCompactEntries() {
+	used := len(in.index)
+	if used*2 > len(in.entries) {
+		return
 	}
 
-	var e fuseutil.Dirent
-	for i, e = range in.entries {
-		if e.Name == name {
-			ok = true
-			return
+	entries := make([]fuseutil.Dirent, 0, used)
+	for _, e := range in.entries {
+		if e.Type != fuseutil.DT_Unknown {
+			in.index[e.Name] = len(entries)
+			entries = append(entries, e)
 		}
 	}
 
-	return
+	in.entries = entries
 }
 
 ////////////////////////////////////////////////////////////////////////
@@ -169,8 +351,16 @@ func (in *inode) findChild(name string) (i int, ok bool) {
 //
 // REQUIRES: in.isDir()
 func (in *inode) Len() (n int) {
+	n = len(in.index)
+	return
+}
+
+// Return the number of children that are directories.
+//
+// REQUIRES: in.isDir()
+func (in *inode) subdirs() (n uint32) {
 	for _, e := range in.entries {
-		if e.Type != fuseutil.DT_Unknown {
+		if e.Type == fuseutil.DT_Directory {
 			n++
 		}
 	}
@@ -178,9 +368,8 @@ func (in *inode) Len() (n int) {
 	return
 }
 
-// Find an entry for the given child name and return its inode ID.
-//
-// REQUIRES: in.isDir()
+// Find an entry for the given child name and return its inode ID. A
+// non-directory has no entries.
 func (in *inode) LookUpChild(name string) (
 	id fuseops.InodeID,
 	typ fuseutil.DirentType,
@@ -194,7 +383,7 @@ func (in *inode) LookUpChild(name string) (
 	return
 }
 
-// Add an entry for a child.
+// Add an entry for a child. A child directory's ".." links to this one.
 //
 // REQUIRES: in.isDir()
 // REQUIRES: dt != fuseutil.DT_Unknown
@@ -202,67 +391,101 @@ func (in *inode) AddChild(
 	id fuseops.InodeID,
 	name string,
 	dt fuseutil.DirentType) {
-	var index int
-
-	// Update the modification time.
-	in.attrs.Mtime = time.Now()
+	// Update the modification and change times.
+	in.touch()
 
-	// No matter where we place the entry, make sure it has the correct Offset
-	// field.
-	defer func() {
-		in.entries[index].Offset = fuseops.DirOffset(index + 1)
-	}()
+	// Offsets start after those of "." and "..".
+	if in.nextOffset == 0 {
+		in.nextOffset = dotDotOffset + 1
+	}
 
-	// Set up the entry.
-	e := fuseutil.Dirent{
-		Inode: id,
-		Name:  name,
-		Type:  dt,
+	if dt == fuseutil.DT_Directory {
+		in.attrs.Nlink++
 	}
 
-	// Look for a gap in which we can insert it.
-	for index = range in.entries {
-		if in.entries[index].Type == fuseutil.DT_Unknown {
-			in.entries[index] = e
-			return
-		}
+	if in.index == nil {
+		in.index = make(map[string]int)
 	}
 
-	// Append it to the end.
-	index = len(in.entries)
-	in.entries = append(in.entries, e)
+	// Append the entry with the next offset.
+	in.index[name] = len(in.entries)
+	in.entries = append(in.entries, fuseutil.Dirent{
+		Offset: in.nextOffset,
+		Inode:  id,
+		Name:   name,
+		Type:   dt,
+	})
+
+	in.nextOffset++
 }
 
-// Remove an entry for a child.
-//
-// REQUIRES: in.isDir()
-// REQUIRES: An entry for the given name exists.
+// Remove an entry for a child. Do nothing if there is no such entry.
 func (in *inode) RemoveChild(name string) {
-	// Update the modification time.
-	in.attrs.Mtime = time.Now()
-
 	// Find the entry.
 	i, ok := in.findChild(name)
 	if !ok {
-		panic(fmt.Sprintf("Unknown child: %s", name))
+		return
+	}
+
+	// Update the modification and change times.
+	in.touch()
+
+	if in.entries[i].Type == fuseutil.DT_Directory {
+		in.attrs.Nlink--
 	}
 
 	// Mark it as unused.
 	in.entries[i] = fuseutil.Dirent{
 		Type:   fuseutil.DT_Unknown,
-		Offset: fuseops.DirOffset(i + 1),
+		Offset: in.entries[i].Offset,
 	}
+
+	delete(in.index, name)
+	in.maybeCompactEntries()
 }
 
-// Serve a ReadDir request.
-//
-// REQUIRES: in.isDir()
-func (in *inode) ReadDir(p []byte, offset int) (n int) {
-	if !in.isDir() {
-		panic("ReadDir called on non-directory.")
+// Serve a ReadDir request, returning the entries following the given offset.
+// The directory's own ID is needed for its "." entry, and for the ".." entry
+// of the root.
+func (in *inode) ReadDir(
+	id fuseops.InodeID,
+	p []byte,
+	offset fuseops.DirOffset) (n int) {
+	// A removed directory is empty, without even "." and "..", and a
+	// non-directory has nothing to list at all.
+	if !in.isDir() || in.attrs.Nlink == 0 {
+		return
+	}
+
+	parent := in.parentID()
+	if parent == 0 {
+		parent = id
+	}
+
+	dots := []fuseutil.Dirent{
+		{Offset: dotOffset, Inode: id, Name: ".", Type: fuseutil.DT_Directory},
+		{Offset: dotDotOffset, Inode: parent, Name: "..", Type: fuseutil.DT_Directory},
+	}
+
+	for _, e := range dots {
+		if e.Offset <= offset {
+			continue
+		}
+
+		tmp := fuseutil.WriteDirent(p[n:], e)
+		if tmp == 0 {
+			return
+		}
+
+		n += tmp
 	}
 
-	for i := offset; i < len(in.entries); i++ {
+	// Find the first entry after the offset.
+	start := sort.Search(len(in.entries), func(i int) bool {
+		return in.entries[i].Offset > offset
+	})
+
+	for i := start; i < len(in.entries); i++ {
 		e := in.entries[i]
 
 		// Skip unused entries.
@@ -282,80 +505,117 @@ func (in *inode) ReadDir(p []byte, offset int) (n int) {
 }
 
 // Read from the file's contents. See documentation for ioutil.ReaderAt.
-//
-// REQUIRES: in.isFile()
+// Return EINVAL for anything but a file.
 func (in *inode) ReadAt(p []byte, off int64) (n int, err error) {
 	if !in.isFile() {
-		panic("ReadAt called on non-file.")
+		err = syscall.EINVAL
+		return
+	}
+
+	// Ensure the offset is in range.
+	if off > int64(in.attrs.Size) {
+		err = io.EOF
+		return
+	}
+
+	// Read what we can. Holes read as zeros.
+	n = len(p)
+	if rest := int64(in.attrs.Size) - off; int64(n) > rest {
+		n = int(rest)
+		err = io.EOF
+	}
+
+	in.contents.readAt(p[:n], off)
+
+	return
+}
+
+// Like ReadAt, but return up to n bytes as slices that share memory with the
+// contents rather than copying them. The slices remain valid and unchanged
+// after the lock is released, whatever happens to the file afterwards.
+func (in *inode) ReadSlices(
+	n int,
+	off int64) (data [][]byte, bytesRead int, err error) {
+	if !in.isFile() {
+		err = syscall.EINVAL
+		return
 	}
 
 	// Ensure the offset is in range.
-	if off > int64(len(in.contents)) {
+	if off > int64(in.attrs.Size) {
 		err = io.EOF
 		return
 	}
 
-	// Read what we can.
-	n = copy(p, in.contents[off:])
-	if n < len(p) {
+	// Read what we can. Holes read as zeros.
+	bytesRead = n
+	if rest := int64(in.attrs.Size) - off; int64(bytesRead) > rest {
+		bytesRead = int(rest)
 		err = io.EOF
 	}
 
+	data = in.contents.slices(off, int64(bytesRead))
+
 	return
 }
 
 // Write to the file's contents. See documentation for ioutil.WriterAt.
-//
-// REQUIRES: in.isFile()
+// Return EINVAL for anything but a file.
 func (in *inode) WriteAt(p []byte, off int64) (n int, err error) {
 	if !in.isFile() {
-		panic("WriteAt called on non-file.")
+		err = syscall.EINVAL
+		return
 	}
 
-	// Update the modification time.
-	in.attrs.Mtime = time.Now()
+	// Update the modification and change times.
+	in.touch()
 
-	// Ensure that the contents slice is long enough.
-	newLen := int(off) + len(p)
-	if len(in.contents) < newLen {
-		padding := make([]byte, newLen-len(in.contents))
-		in.contents = append(in.contents, padding...)
-		in.attrs.Size = uint64(newLen)
+	// Copy in the data. Anything between the old end of the file and off
+	// becomes a hole.
+	in.contents.writeAt(p, off)
+	n = len(p)
+
+	// Extend the file if necessary.
+	if newSize := uint64(off) + uint64(len(p)); in.attrs.Size < newSize {
+		in.attrs.Size = newSize
 	}
 
-	// Copy in the data.
-	n = copy(in.contents[off:], p)
+	return
+}
+
+// Change the owner and group to the non-nil parameters.
+func (in *inode) SetOwner(uid *uint32, gid *uint32) {
+	// Update the change time.
+	in.attrs.Ctime = time.Now()
 
-	// Sanity check.
-	if n != len(p) {
-		panic(fmt.Sprintf("Unexpected short copy: %v", n))
+	if uid != nil {
+		in.attrs.Uid = *uid
 	}
 
-	return
+	if gid != nil {
+		in.attrs.Gid = *gid
+	}
 }
 
-// Update attributes from non-nil parameters.
+// Update attributes from non-nil parameters. Any change updates the change
+// time, and changing the size also updates the modification time.
 func (in *inode) SetAttributes(
 	size *uint64,
 	mode *os.FileMode,
+	atime *time.Time,
 	mtime *time.Time) {
-	// Update the modification time.
-	in.attrs.Mtime = time.Now()
+	// Update the change time.
+	in.attrs.Ctime = time.Now()
 
-	// Truncate?
+	// Truncate? Extending the file leaves a hole, which costs nothing.
 	if size != nil {
-		intSize := int(*size)
-
-		// Update contents.
-		if intSize <= len(in.contents) {
-			in.contents = in.contents[:intSize]
-		} else {
-			padding := make([]byte, intSize-len(in.contents))
-			in.contents = append(in.contents, padding...)
+		if *size < in.attrs.Size {
+			in.contents.truncate(*size)
 		}
 
 		// Update attributes.
 		in.attrs.Size = *size
+		in.attrs.Mtime = in.attrs.Ctime
 	}
 
 	// Change mode?
@@ -363,6 +623,11 @@ func (in *inode) SetAttributes(
 		in.attrs.Mode = *mode
 	}
 
+	// Change atime?
+	if atime != nil {
+		in.attrs.Atime = *atime
+	}
+
 	// Change mtime?
 	if mtime != nil {
 		in.attrs.Mtime = *mtime
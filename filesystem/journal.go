@@ -0,0 +1,612 @@
+package filesystem
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A journal file starts with journalMagic, followed by the format version and
+// the journal generation as big-endian uint32 and uint64, followed by a single
+// gob stream of journalRecord values.
+//
+// The journal only ever continues the checkpoint with the same generation. A
+// new checkpoint is written with the next generation before the journal is
+// truncated, so a crash in between leaves a stale journal that is ignored
+// rather than applied twice. A journal newer than the checkpoint means the
+// checkpoint was lost, and recovery fails rather than silently dropping
+// synced changes.
+const (
+	journalMagic   = "memfs journal\n"
+	journalVersion = 1
+
+	checkpointSuffix = ".checkpoint"
+)
+
+// Besides at mount and unmount, a checkpoint is written in the background once
+// the journal has grown past both checkpointMinJournalSize and
+// checkpointJournalFactor times the bytes of file contents. Writing a
+// checkpoint costs about as much as the contents, so this keeps the time spent
+// on checkpoints proportional to the time spent journaling, while bounding
+// both the size of the journal and the time it takes to replay it.
+//
+// A background checkpoint holds fs.opsMu for writing while it serializes the
+// whole file system and syncs it to disk, so every op stalls for that long:
+// roughly the time to write out the file contents once. These thresholds are
+// what keep such stalls rare.
+const (
+	checkpointMinJournalSize = 64 << 20
+	checkpointJournalFactor  = 2
+)
+
+type journalRecordType uint8
+
+const (
+	// Install a new inode with Attrs and Target at Inode.
+	recordAlloc journalRecordType = iota + 1
+
+	// Free the inode at Inode.
+	recordFree
+
+	// Replace the attributes of Inode with Attrs.
+	recordAttrs
+
+	// Add an entry for Child named Name with type DirentType to directory Inode.
+	recordAddChild
+
+	// Remove the entry named Name from directory Inode.
+	recordRemoveChild
+
+	// Write Data to file Inode at Offset.
+	recordWrite
+
+	// Truncate or extend file Inode to Offset bytes.
+	recordTruncate
+
+	// Set the extended attribute Name of Inode to Data.
+	recordSetXattr
+
+	// Remove the extended attribute Name of Inode.
+	recordRemoveXattr
+
+	// Allocate space for Length bytes of file Inode at Offset.
+	recordAllocate
+
+	// Zero Length bytes of file Inode at Offset, leaving the space allocated.
+	recordZeroRange
+
+	// Zero Length bytes of file Inode at Offset, releasing whole pages.
+	recordPunchHole
+)
+
+// A single change to the inode table. Records describe the effect of an op
+// rather than the op itself, so that replaying them doesn't depend on kernel
+// state such as lookup counts.
+type journalRecord struct {
+	Type  journalRecordType
+	Inode fuseops.InodeID
+
+	Attrs  fuseops.InodeAttributes
+	Target string
+
+	Name       string
+	Child      fuseops.InodeID
+	DirentType fuseutil.DirentType
+
+	Offset int64
+	Length int64
+	Data   []byte
+}
+
+////////////////////////////////////////////////////////////////////////
+// journal type
+////////////////////////////////////////////////////////////////////////
+
+// An append-only log of journal records.
+type journal struct {
+	mu sync.Mutex
+
+	f   *os.File       // GUARDED_BY(mu)
+	w   *bufio.Writer  // GUARDED_BY(mu)
+	n   countingWriter // GUARDED_BY(mu)
+	enc *gob.Encoder   // GUARDED_BY(mu)
+	err error          // GUARDED_BY(mu)
+}
+
+// Counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	cw.n += int64(n)
+	return
+}
+
+// Create an empty journal with the given generation at the given path,
+// replacing any existing file.
+func createJournal(path string, generation uint64) (j *journal, err error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return
+	}
+
+	w := bufio.NewWriter(f)
+
+	_, err = io.WriteString(w, journalMagic)
+	if err == nil {
+		err = binary.Write(w, binary.BigEndian, uint32(journalVersion))
+	}
+
+	if err == nil {
+		err = binary.Write(w, binary.BigEndian, generation)
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if err == nil {
+		err = f.Sync()
+	}
+
+	// The journal may be new, in which case its directory entry needs to be
+	// durable too.
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+
+	if err != nil {
+		f.Close()
+		err = fmt.Errorf("Writing journal header: %v", err)
+		return
+	}
+
+	j = &journal{
+		f: f,
+		w: w,
+		n: countingWriter{w: w},
+	}
+
+	j.enc = gob.NewEncoder(&j.n)
+	return
+}
+
+// Append a record to the journal, and return the number of bytes of records
+// appended so far. The record is not durable until the next call to sync.
+// Errors are sticky and reported by sync.
+func (j *journal) append(r *journalRecord) (size int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.err != nil {
+		return
+	}
+
+	if err := j.enc.Encode(r); err != nil {
+		j.err = fmt.Errorf("Appending to journal: %v", err)
+		log.Printf("ERROR %v", j.err)
+	}
+
+	size = j.n.n
+	return
+}
+
+// Make every record appended so far durable.
+func (j *journal) sync() (err error) {
+	j.mu.Lock()
+
+	if j.err == nil {
+		if err := j.w.Flush(); err != nil {
+			j.err = fmt.Errorf("Flushing journal: %v", err)
+			log.Printf("ERROR %v", j.err)
+		}
+	}
+
+	err = j.err
+	j.mu.Unlock()
+
+	if err != nil {
+		return
+	}
+
+	// Don't hold the lock while waiting for the disk, so that appends can
+	// proceed in the meantime. They will be covered by a later sync.
+	err = j.f.Sync()
+	return
+}
+
+// Return the number of bytes of records appended so far.
+func (j *journal) size() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.n.n
+}
+
+func (j *journal) close() (err error) {
+	err = j.sync()
+
+	if closeErr := j.f.Close(); err == nil {
+		err = closeErr
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Recording
+////////////////////////////////////////////////////////////////////////
+
+func (fs *fileSystem) record(r *journalRecord) {
+	if fs.journal == nil {
+		return
+	}
+
+	if fs.journal.append(r) > fs.checkpointThreshold() {
+		fs.requestCheckpoint()
+	}
+}
+
+// The records for an inode are appended while holding its lock, so that they
+// appear in the journal in the order the changes were made.
+//
+// LOCKS_REQUIRED(in.mu)
+func (fs *fileSystem) recordAlloc(id fuseops.InodeID, in *inode) {
+	if fs.journal == nil {
+		return
+	}
+
+	fs.record(&journalRecord{
+		Type:   recordAlloc,
+		Inode:  id,
+		Attrs:  in.attrs,
+		Target: in.target,
+	})
+}
+
+// LOCKS_REQUIRED(in.mu)
+func (fs *fileSystem) recordAttrs(id fuseops.InodeID, in *inode) {
+	if fs.journal == nil {
+		return
+	}
+
+	fs.record(&journalRecord{
+		Type:  recordAttrs,
+		Inode: id,
+		Attrs: in.attrs,
+	})
+}
+
+// LOCKS_REQUIRED(parent.mu)
+func (fs *fileSystem) recordAddChild(
+	parentID fuseops.InodeID,
+	parent *inode,
+	name string,
+	child fuseops.InodeID,
+	dt fuseutil.DirentType) {
+	fs.record(&journalRecord{
+		Type:       recordAddChild,
+		Inode:      parentID,
+		Name:       name,
+		Child:      child,
+		DirentType: dt,
+	})
+	fs.recordAttrs(parentID, parent)
+}
+
+// LOCKS_REQUIRED(parent.mu)
+func (fs *fileSystem) recordRemoveChild(
+	parentID fuseops.InodeID,
+	parent *inode,
+	name string) {
+	fs.record(&journalRecord{
+		Type:  recordRemoveChild,
+		Inode: parentID,
+		Name:  name,
+	})
+	fs.recordAttrs(parentID, parent)
+}
+
+////////////////////////////////////////////////////////////////////////
+// Recovery
+////////////////////////////////////////////////////////////////////////
+
+// Restore the file system from the checkpoint and journal at the given path,
+// then start a fresh checkpoint and journal. This and the functions below must
+// be called only while the file system is not being served.
+func (fs *fileSystem) recoverJournal(path string) (err error) {
+	fs.journalPath = path
+
+	// Load the last checkpoint, if there is one.
+	err = fs.loadSnapshot(path + checkpointSuffix)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+
+	if err != nil {
+		return
+	}
+
+	// Replay the journal on top of it.
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		err = nil
+	} else if err == nil {
+		err = fs.replayJournal(bufio.NewReader(f))
+		f.Close()
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Replaying journal %s: %v", path, err)
+		return
+	}
+
+	// Anything unlinked but still open when the journal ended is gone now.
+	fs.freeUnreachableInodes()
+
+	// Fold everything into a new checkpoint.
+	err = fs.checkpoint()
+	return
+}
+
+// Write a checkpoint of the current state and start a new, empty journal
+// following it. If the checkpoint can't be written, the old journal stays in
+// use.
+func (fs *fileSystem) checkpoint() (err error) {
+	fs.journalGeneration++
+
+	err = fs.saveSnapshot(fs.journalPath + checkpointSuffix)
+	if err != nil {
+		fs.journalGeneration--
+		err = fmt.Errorf("Writing checkpoint: %v", err)
+		return
+	}
+
+	// The checkpoint covers everything in the old journal now. Close it before
+	// truncating the file, so that nothing buffered is written on top of the
+	// new journal. A journal that failed to be created has no file to close.
+	//
+	// Start the new journal even if closing the old one fails, since the
+	// checkpoint doesn't depend on it.
+	var closeErr error
+	if fs.journal != nil && fs.journal.f != nil {
+		closeErr = fs.journal.close()
+	}
+
+	fs.journal, err = createJournal(fs.journalPath, fs.journalGeneration)
+	if err != nil {
+		// Fail every later sync, rather than silently not journaling.
+		err = fmt.Errorf("Creating journal: %v", err)
+		fs.journal = &journal{err: err}
+		return
+	}
+
+	if closeErr != nil {
+		err = fmt.Errorf("Closing journal: %v", closeErr)
+		return
+	}
+
+	return
+}
+
+// Return the size of the journal past which a checkpoint is due.
+func (fs *fileSystem) checkpointThreshold() int64 {
+	threshold := int64(atomic.LoadUint64(&fs.usedBytes)) * checkpointJournalFactor
+	if threshold < fs.checkpointMinJournalSize {
+		threshold = fs.checkpointMinJournalSize
+	}
+
+	return threshold
+}
+
+// Ask for a checkpoint to be written in the background, unless one has already
+// been asked for.
+func (fs *fileSystem) requestCheckpoint() {
+	select {
+	case fs.checkpointRequests <- struct{}{}:
+	default:
+	}
+}
+
+// Write checkpoints as they are requested, until the requests channel is
+// closed. Each checkpoint waits for the ops under way to finish, and holds off
+// new ones until it is done.
+func (fs *fileSystem) checkpointLoop() {
+	defer close(fs.checkpointDone)
+
+	for range fs.checkpointRequests {
+		fs.opsMu.Lock()
+
+		if fs.journal != nil && fs.journal.size() > fs.checkpointThreshold() {
+			if err := fs.checkpoint(); err != nil {
+				log.Printf("ERROR Background checkpoint: %v", err)
+			}
+		}
+
+		fs.opsMu.Unlock()
+	}
+}
+
+// Apply the records in the given journal, if it continues the current state.
+// A truncated or corrupt tail, as left behind by a crash, ends the replay.
+func (fs *fileSystem) replayJournal(r io.Reader) (err error) {
+	// Check the header.
+	magic := make([]byte, len(journalMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil || string(magic) != journalMagic {
+		err = fmt.Errorf("Not a memfs journal")
+		return
+	}
+
+	var version uint32
+	var generation uint64
+	err = binary.Read(r, binary.BigEndian, &version)
+	if err == nil {
+		err = binary.Read(r, binary.BigEndian, &generation)
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Reading header: %v", err)
+		return
+	}
+
+	if version != journalVersion {
+		err = fmt.Errorf("Unsupported journal version: %d", version)
+		return
+	}
+
+	// A journal from an earlier generation is already part of the checkpoint.
+	// One from a later generation continues a checkpoint we don't have, and
+	// applying it to an older one would be as wrong as dropping it.
+	if generation < fs.journalGeneration {
+		return
+	}
+
+	if generation > fs.journalGeneration {
+		err = fmt.Errorf(
+			"Journal generation %d is newer than checkpoint generation %d",
+			generation,
+			fs.journalGeneration)
+		return
+	}
+
+	dec := gob.NewDecoder(r)
+	for n := 0; ; n++ {
+		var rec journalRecord
+		err = dec.Decode(&rec)
+		if err == io.EOF {
+			err = nil
+			return
+		}
+
+		if err != nil {
+			log.Printf("WARN Ignoring journal tail after %d records: %v", n, err)
+			err = nil
+			return
+		}
+
+		err = fs.applyRecord(&rec)
+		if err != nil {
+			err = fmt.Errorf("Record %d: %v", n, err)
+			return
+		}
+	}
+}
+
+func (fs *fileSystem) applyRecord(r *journalRecord) (err error) {
+	// Every record but an allocation refers to an existing inode.
+	in := fs.getInode(r.Inode)
+
+	if r.Type == recordAlloc {
+		if in != nil || r.Inode <= fuseops.RootInodeID {
+			err = fmt.Errorf("Cannot allocate inode %v", r.Inode)
+			return
+		}
+
+		in = fs.allocateInodeAt(r.Inode, r.Attrs)
+		in.attrs = r.Attrs
+		in.target = r.Target
+		return
+	}
+
+	if in == nil {
+		err = fmt.Errorf("Unknown inode %v", r.Inode)
+		return
+	}
+
+	switch r.Type {
+	case recordFree:
+		fs.deallocateInode(r.Inode, in)
+
+	case recordAttrs:
+		if r.Attrs.Size != in.attrs.Size {
+			err = fmt.Errorf("Size mismatch for inode %v", r.Inode)
+			return
+		}
+
+		in.attrs = r.Attrs
+
+	case recordAddChild:
+		if !in.isDir() {
+			err = fmt.Errorf("Inode %v is not a directory", r.Inode)
+			return
+		}
+
+		if _, _, exists := in.LookUpChild(r.Name); exists {
+			err = fmt.Errorf("Entry %q already exists in %v", r.Name, r.Inode)
+			return
+		}
+
+		in.AddChild(r.Child, r.Name, r.DirentType)
+
+		if r.DirentType == fuseutil.DT_Directory {
+			child := fs.getInode(r.Child)
+			if child == nil {
+				err = fmt.Errorf("Unknown child %v", r.Child)
+				return
+			}
+
+			child.setParentID(r.Inode)
+		}
+
+	case recordRemoveChild:
+		if !in.isDir() {
+			err = fmt.Errorf("Inode %v is not a directory", r.Inode)
+			return
+		}
+
+		if _, _, exists := in.LookUpChild(r.Name); !exists {
+			err = fmt.Errorf("No entry %q in %v", r.Name, r.Inode)
+			return
+		}
+
+		in.RemoveChild(r.Name)
+
+	case recordWrite:
+		if !in.isFile() {
+			err = fmt.Errorf("Inode %v is not a file", r.Inode)
+			return
+		}
+
+		err = fs.writeContents(in, r.Data, r.Offset)
+
+	case recordTruncate:
+		fs.truncateContents(in, uint64(r.Offset))
+
+	case recordAllocate, recordZeroRange, recordPunchHole:
+		if !in.isFile() {
+			err = fmt.Errorf("Inode %v is not a file", r.Inode)
+			return
+		}
+
+		if r.Type == recordPunchHole {
+			fs.punchContents(in, r.Offset, r.Length)
+		} else {
+			err = fs.allocateContents(in, r.Offset, r.Length, r.Type == recordZeroRange)
+		}
+
+	case recordSetXattr:
+		in.xattrs[r.Name] = r.Data
+
+	case recordRemoveXattr:
+		delete(in.xattrs, r.Name)
+
+	default:
+		err = fmt.Errorf("Unknown record type %d", r.Type)
+	}
+
+	return
+}
@@ -0,0 +1,328 @@
+package filesystem
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+)
+
+// A wrapper around the file system that turns a panic while serving an op into
+// an EIO response for that op alone, rather than letting it crash the daemon
+// and leave a dead mount point behind. It also holds fs.opsMu for reading
+// while each op runs, so that background checkpoints see a consistent state.
+// Ops the wrapper doesn't know about are passed through as they are.
+type recoveringFileSystem struct {
+	*fileSystem
+}
+
+// Hold off background checkpoints until the returned function is called.
+//
+// LOCKS_EXCLUDED(fs.opsMu)
+func (r recoveringFileSystem) enter() (leave func()) {
+	r.fileSystem.opsMu.RLock()
+	return r.fileSystem.opsMu.RUnlock
+}
+
+// Recover from a panic in the given op, if there is one, logging it and
+// failing the op with EIO. Must be deferred directly by the op.
+//
+// Panics from invariant checks are passed on rather than recovered. Such a
+// check may run as a lock is released, with the lock still held, so the op
+// failing would leave every later op that wants the lock stuck behind it.
+// Invariant checks are for debugging anyway, and a violation means the state
+// can't be trusted.
+func (r recoveringFileSystem) recover(op interface{}, err *error) {
+	v := recover()
+	if v == nil {
+		return
+	}
+
+	if _, ok := v.(invariantViolation); ok {
+		panic(v)
+	}
+
+	log.Printf(
+		"ERROR Recovered from panic in %T: %v\n%s\n%s",
+		op,
+		v,
+		r.fileSystem.summary(),
+		debug.Stack())
+
+	*err = fuse.EIO
+}
+
+// Describe the state of the file system for a log message. This must not take
+// any locks, since the panic may have left some of them held.
+func (fs *fileSystem) summary() string {
+	return fmt.Sprintf(
+		"State: %d inodes (limit %d), %d open handles, %d of %d bytes used",
+		atomic.LoadUint64(&fs.numInodes),
+		fs.inodeLimit,
+		atomic.LoadUint64(&fs.numHandles),
+		atomic.LoadUint64(&fs.usedBytes),
+		fs.sizeLimit)
+}
+
+// A panic raised by an invariant check, wrapping the original value.
+type invariantViolation struct {
+	v interface{}
+}
+
+func (v invariantViolation) Error() string {
+	return fmt.Sprint(v.v)
+}
+
+// Wrap the given invariant check so that recover can tell its panics apart
+// from others.
+func invariantCheck(check func()) func() {
+	return func() {
+		defer func() {
+			if v := recover(); v != nil {
+				panic(invariantViolation{v})
+			}
+		}()
+
+		check()
+	}
+}
+
+////////////////////////////////////////////////////////////////////////
+// FileSystem methods
+////////////////////////////////////////////////////////////////////////
+
+func (r recoveringFileSystem) StatFS(
+	ctx context.Context,
+	op *fuseops.StatFSOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.StatFS(ctx, op)
+}
+
+func (r recoveringFileSystem) LookUpInode(
+	ctx context.Context,
+	op *fuseops.LookUpInodeOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.LookUpInode(ctx, op)
+}
+
+func (r recoveringFileSystem) GetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.GetInodeAttributesOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.GetInodeAttributes(ctx, op)
+}
+
+func (r recoveringFileSystem) SetInodeAttributes(
+	ctx context.Context,
+	op *fuseops.SetInodeAttributesOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.SetInodeAttributes(ctx, op)
+}
+
+func (r recoveringFileSystem) ForgetInode(
+	ctx context.Context,
+	op *fuseops.ForgetInodeOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.ForgetInode(ctx, op)
+}
+
+func (r recoveringFileSystem) BatchForget(
+	ctx context.Context,
+	op *fuseops.BatchForgetOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.BatchForget(ctx, op)
+}
+
+func (r recoveringFileSystem) MkDir(
+	ctx context.Context,
+	op *fuseops.MkDirOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.MkDir(ctx, op)
+}
+
+func (r recoveringFileSystem) MkNode(
+	ctx context.Context,
+	op *fuseops.MkNodeOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.MkNode(ctx, op)
+}
+
+func (r recoveringFileSystem) CreateFile(
+	ctx context.Context,
+	op *fuseops.CreateFileOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.CreateFile(ctx, op)
+}
+
+func (r recoveringFileSystem) CreateLink(
+	ctx context.Context,
+	op *fuseops.CreateLinkOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.CreateLink(ctx, op)
+}
+
+func (r recoveringFileSystem) CreateSymlink(
+	ctx context.Context,
+	op *fuseops.CreateSymlinkOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.CreateSymlink(ctx, op)
+}
+
+func (r recoveringFileSystem) Rename(
+	ctx context.Context,
+	op *fuseops.RenameOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.Rename(ctx, op)
+}
+
+func (r recoveringFileSystem) RmDir(
+	ctx context.Context,
+	op *fuseops.RmDirOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.RmDir(ctx, op)
+}
+
+func (r recoveringFileSystem) Unlink(
+	ctx context.Context,
+	op *fuseops.UnlinkOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.Unlink(ctx, op)
+}
+
+func (r recoveringFileSystem) OpenDir(
+	ctx context.Context,
+	op *fuseops.OpenDirOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.OpenDir(ctx, op)
+}
+
+func (r recoveringFileSystem) ReadDir(
+	ctx context.Context,
+	op *fuseops.ReadDirOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.ReadDir(ctx, op)
+}
+
+func (r recoveringFileSystem) ReleaseDirHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseDirHandleOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.ReleaseDirHandle(ctx, op)
+}
+
+func (r recoveringFileSystem) OpenFile(
+	ctx context.Context,
+	op *fuseops.OpenFileOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.OpenFile(ctx, op)
+}
+
+func (r recoveringFileSystem) ReadFile(
+	ctx context.Context,
+	op *fuseops.ReadFileOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.ReadFile(ctx, op)
+}
+
+func (r recoveringFileSystem) WriteFile(
+	ctx context.Context,
+	op *fuseops.WriteFileOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.WriteFile(ctx, op)
+}
+
+func (r recoveringFileSystem) SyncFile(
+	ctx context.Context,
+	op *fuseops.SyncFileOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.SyncFile(ctx, op)
+}
+
+func (r recoveringFileSystem) FlushFile(
+	ctx context.Context,
+	op *fuseops.FlushFileOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.FlushFile(ctx, op)
+}
+
+func (r recoveringFileSystem) ReleaseFileHandle(
+	ctx context.Context,
+	op *fuseops.ReleaseFileHandleOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.ReleaseFileHandle(ctx, op)
+}
+
+func (r recoveringFileSystem) ReadSymlink(
+	ctx context.Context,
+	op *fuseops.ReadSymlinkOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.ReadSymlink(ctx, op)
+}
+
+func (r recoveringFileSystem) RemoveXattr(
+	ctx context.Context,
+	op *fuseops.RemoveXattrOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.RemoveXattr(ctx, op)
+}
+
+func (r recoveringFileSystem) GetXattr(
+	ctx context.Context,
+	op *fuseops.GetXattrOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.GetXattr(ctx, op)
+}
+
+func (r recoveringFileSystem) ListXattr(
+	ctx context.Context,
+	op *fuseops.ListXattrOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.ListXattr(ctx, op)
+}
+
+func (r recoveringFileSystem) SetXattr(
+	ctx context.Context,
+	op *fuseops.SetXattrOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.SetXattr(ctx, op)
+}
+
+func (r recoveringFileSystem) Fallocate(
+	ctx context.Context,
+	op *fuseops.FallocateOp) (err error) {
+	defer r.recover(op, &err)
+	defer r.enter()()
+	return r.fileSystem.Fallocate(ctx, op)
+}
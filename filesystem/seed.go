@@ -0,0 +1,490 @@
+package filesystem
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/jacobsa/fuse"
+	"github.com/jacobsa/fuse/fuseops"
+	"golang.org/x/sys/unix"
+)
+
+// The size of the chunks file contents are copied in when seeding. A multiple
+// of pageSize, so that pages of zeros can be left as holes.
+const seedChunkSize = 256 * pageSize
+
+// SeedProgress is told how many bytes of file contents Seed has copied so
+// far, out of the total it is going to copy.
+type SeedProgress func(copied, total int64)
+
+// A file or directory found while seeding.
+type seedEntry struct {
+	path string
+	rel  string
+	fi   os.FileInfo
+}
+
+// The times of an inode, applied once its directory entries are all in place.
+type seedTimes struct {
+	in    *inode
+	atime time.Time
+	mtime time.Time
+	ctime time.Time
+}
+
+// Seed copies the tree under the given host directory into the root of the
+// file system, preserving modes, ownership, timestamps, symlinks, hard links
+// and extended attributes, as cp -a would. The root takes on those of the
+// host directory itself, in place of the configured ones. It fails if a name
+// it copies already exists. If progress is non-nil, it is called as file
+// contents are copied.
+//
+// Seed must be called only before the file system is served.
+func (s *Server) Seed(dir string, progress SeedProgress) (err error) {
+	err = s.fs.seed(dir, progress)
+	return
+}
+
+func (fs *fileSystem) seed(dir string, progress SeedProgress) (err error) {
+	// Find everything to copy first, so that progress can be reported against
+	// the total. Walk visits directories before their contents. Files with
+	// more than one link are recorded by device and inode number, so that
+	// they are copied once and hard links stay hard links.
+	type hostInode struct{ dev, ino uint64 }
+
+	var root seedEntry
+	var entries []seedEntry
+	var total int64
+	counted := make(map[hostInode]struct{})
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			root = seedEntry{path: path, rel: rel, fi: fi}
+			return nil
+		}
+
+		entries = append(entries, seedEntry{path: path, rel: rel, fi: fi})
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+			key := hostInode{uint64(st.Dev), uint64(st.Ino)}
+			if _, ok := counted[key]; ok {
+				return nil
+			}
+
+			counted[key] = struct{}{}
+		}
+
+		total += fi.Size()
+
+		return nil
+	})
+
+	if err != nil {
+		err = fmt.Errorf("Walking %s: %v", dir, err)
+		return
+	}
+
+	if progress == nil {
+		progress = func(int64, int64) {}
+	}
+
+	progress(0, total)
+
+	// Copy the attributes of the host directory to the root.
+	rootSt, ok := root.fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		err = fmt.Errorf("No stat information for %s", dir)
+		return
+	}
+
+	rootInode, err := fs.seedRoot(root, rootSt)
+	if err != nil {
+		err = fmt.Errorf("Copying %s: %v", dir, err)
+		return
+	}
+
+	atime, ctime := statTimes(rootSt)
+	times := []seedTimes{{rootInode, atime, root.fi.ModTime(), ctime}}
+
+	// Copy the entries, recording the inodes of directories by path.
+	dirs := map[string]fuseops.InodeID{".": fuseops.RootInodeID}
+	links := make(map[hostInode]fuseops.InodeID)
+	var copied int64
+
+	for _, e := range entries {
+		st, ok := e.fi.Sys().(*syscall.Stat_t)
+		if !ok {
+			err = fmt.Errorf("No stat information for %s", e.path)
+			return
+		}
+
+		parentID := dirs[filepath.Dir(e.rel)]
+		name := filepath.Base(e.rel)
+
+		// Another link to a file we have already copied?
+		key := hostInode{uint64(st.Dev), uint64(st.Ino)}
+		if id, ok := links[key]; ok {
+			err = fs.seedLink(parentID, name, id)
+			if err != nil {
+				err = fmt.Errorf("Linking %s: %v", e.path, err)
+				return
+			}
+
+			continue
+		}
+
+		mode := e.fi.Mode()
+		if mode&^(os.ModePerm|inodeSpecialBits|inodeTypeBits) != 0 {
+			err = fmt.Errorf("Can't seed %s of type %v", e.path, mode.Type())
+			return
+		}
+
+		var id fuseops.InodeID
+		var in *inode
+		id, in, err = fs.seedInode(e, st, parentID, name, func(n int) {
+			copied += int64(n)
+			progress(copied, total)
+		})
+
+		if err != nil {
+			err = fmt.Errorf("Copying %s: %v", e.path, err)
+			return
+		}
+
+		switch {
+		case e.fi.IsDir():
+			dirs[e.rel] = id
+
+		case st.Nlink > 1:
+			links[key] = id
+		}
+
+		atime, ctime := statTimes(st)
+		times = append(times, seedTimes{in, atime, e.fi.ModTime(), ctime})
+	}
+
+	// Adding entries touched the directories, so restore every time now.
+	for _, t := range times {
+		t.in.mu.Lock()
+		t.in.attrs.Atime = t.atime
+		t.in.attrs.Mtime = t.mtime
+		t.in.attrs.Ctime = t.ctime
+		t.in.mu.Unlock()
+	}
+
+	// The journal continues from a checkpoint, so it needs one that includes
+	// everything copied.
+	if fs.journal != nil {
+		err = fs.checkpoint()
+	}
+
+	return
+}
+
+// Give the root directory the mode, ownership and extended attributes of the
+// given host directory. Its times are left to the caller.
+func (fs *fileSystem) seedRoot(
+	e seedEntry,
+	st *syscall.Stat_t) (in *inode, err error) {
+	xattrs, err := readXattrs(e.path)
+	if err != nil {
+		return
+	}
+
+	in = fs.getInode(fuseops.RootInodeID)
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.attrs.Mode = os.ModeDir | e.fi.Mode()&(os.ModePerm|inodeSpecialBits)
+
+	if !fs.forceUid {
+		in.attrs.Uid = st.Uid
+	}
+
+	if !fs.forceGid {
+		in.attrs.Gid = st.Gid
+	}
+
+	for k, v := range xattrs {
+		in.xattrs[k] = v
+	}
+
+	return
+}
+
+// Create an inode for the given host file or directory as the named child of
+// the given directory, calling copied with the number of bytes of contents
+// copied as it goes.
+func (fs *fileSystem) seedInode(
+	e seedEntry,
+	st *syscall.Stat_t,
+	parentID fuseops.InodeID,
+	name string,
+	copied func(n int)) (id fuseops.InodeID, in *inode, err error) {
+	mode := e.fi.Mode()
+	attrs := fuseops.InodeAttributes{
+		Nlink: 1,
+		Mode:  mode,
+		Uid:   st.Uid,
+		Gid:   st.Gid,
+	}
+
+	if fs.forceUid {
+		attrs.Uid = fs.uid
+	}
+
+	if fs.forceGid {
+		attrs.Gid = fs.gid
+	}
+
+	if mode.IsDir() {
+		attrs.Nlink = 2
+	}
+
+	if mode&os.ModeDevice != 0 {
+		attrs.Rdev = kernelRdev(uint64(st.Rdev))
+	}
+
+	// Read symlinks and extended attributes before touching the file system.
+	var target string
+	if mode&os.ModeSymlink != 0 {
+		target, err = os.Readlink(e.path)
+		if err != nil {
+			return
+		}
+	}
+
+	xattrs, err := readXattrs(e.path)
+	if err != nil {
+		return
+	}
+
+	parent, err := fs.findInode(parentID)
+	if err != nil {
+		return
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	if _, _, exists := parent.LookUpChild(name); exists {
+		err = fmt.Errorf("%q already exists", name)
+		return
+	}
+
+	id, in, err = fs.allocateInode(attrs)
+	if err != nil {
+		return
+	}
+
+	in.mu.Lock()
+	defer in.mu.Unlock()
+
+	in.target = target
+	for k, v := range xattrs {
+		in.xattrs[k] = v
+	}
+
+	if mode.IsRegular() {
+		err = fs.seedContents(in, e.path, copied)
+		if err != nil {
+			// Release what was copied, but still add the file so that the
+			// tree stays consistent.
+			fs.truncateContents(in, 0)
+		}
+	}
+
+	if mode.IsDir() {
+		in.setParentID(parentID)
+	}
+
+	parent.AddChild(id, name, in.direntType())
+
+	return
+}
+
+// Copy the contents of the host file at the given path into the file,
+// leaving pages of zeros as holes.
+//
+// LOCKS_REQUIRED(in.mu)
+func (fs *fileSystem) seedContents(
+	in *inode,
+	path string,
+	copied func(n int)) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	buf := make([]byte, seedChunkSize)
+	var off int64
+	for {
+		var n int
+		n, err = io.ReadFull(f, buf)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return
+		}
+
+		eof := err == io.ErrUnexpectedEOF
+		err = nil
+
+		for start := 0; start < n; start += pageSize {
+			end := start + pageSize
+			if end > n {
+				end = n
+			}
+
+			if isZero(buf[start:end]) {
+				continue
+			}
+
+			err = fs.writeContents(in, buf[start:end], off+int64(start))
+			if err != nil {
+				return
+			}
+		}
+
+		off += int64(n)
+		copied(n)
+
+		if eof {
+			break
+		}
+	}
+
+	// Any holes at the end still count towards the size.
+	if uint64(off) > in.attrs.Size {
+		fs.truncateContents(in, uint64(off))
+	}
+
+	return
+}
+
+// Add another entry for the given non-directory inode to the given directory.
+func (fs *fileSystem) seedLink(
+	parentID fuseops.InodeID,
+	name string,
+	id fuseops.InodeID) (err error) {
+	parent, err := fs.findInode(parentID)
+	if err != nil {
+		return
+	}
+
+	target, err := fs.findInode(id)
+	if err != nil {
+		return
+	}
+
+	parent.mu.Lock()
+	defer parent.mu.Unlock()
+
+	if _, _, exists := parent.LookUpChild(name); exists {
+		err = fmt.Errorf("%q already exists", name)
+		return
+	}
+
+	target.mu.Lock()
+	defer target.mu.Unlock()
+
+	target.attrs.Nlink++
+	parent.AddChild(id, name, target.direntType())
+
+	return
+}
+
+// Read the extended attributes of the file at the given path, without
+// following symlinks. A file system that doesn't support them has none, and
+// attributes we may not read, such as trusted ones, are skipped.
+func readXattrs(path string) (xattrs map[string][]byte, err error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err == unix.ENOTSUP || size == 0 {
+		err = nil
+		return
+	}
+
+	if err != nil {
+		err = fmt.Errorf("Llistxattr: %v", err)
+		return
+	}
+
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		err = fmt.Errorf("Llistxattr: %v", err)
+		return
+	}
+
+	xattrs = make(map[string][]byte)
+	for _, name := range splitXattrNames(buf[:size]) {
+		var n int
+		n, err = unix.Lgetxattr(path, name, nil)
+		if err == unix.EPERM || err == unix.EACCES || err == fuse.ENOATTR {
+			err = nil
+			continue
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Lgetxattr %s: %v", name, err)
+			return
+		}
+
+		value := make([]byte, n)
+		n, err = unix.Lgetxattr(path, name, value)
+		if err != nil {
+			err = fmt.Errorf("Lgetxattr %s: %v", name, err)
+			return
+		}
+
+		xattrs[name] = value[:n]
+	}
+
+	return
+}
+
+// Split a list of NUL-terminated names, as returned by listxattr.
+func splitXattrNames(buf []byte) (names []string) {
+	start := 0
+	for i, b := range buf {
+		if b == 0 {
+			if i > start {
+				names = append(names, string(buf[start:i]))
+			}
+
+			start = i + 1
+		}
+	}
+
+	return
+}
+
+// Is every byte zero?
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
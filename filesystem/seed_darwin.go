@@ -0,0 +1,19 @@
+package filesystem
+
+import (
+	"syscall"
+	"time"
+)
+
+// Return the access and change times of a host file.
+func statTimes(st *syscall.Stat_t) (atime time.Time, ctime time.Time) {
+	atime = time.Unix(st.Atimespec.Unix())
+	ctime = time.Unix(st.Ctimespec.Unix())
+	return
+}
+
+// Convert a host device number to the encoding the kernel uses for FUSE,
+// which on macOS is the same.
+func kernelRdev(rdev uint64) uint32 {
+	return uint32(rdev)
+}
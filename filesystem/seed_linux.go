@@ -0,0 +1,22 @@
+package filesystem
+
+import (
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Return the access and change times of a host file.
+func statTimes(st *syscall.Stat_t) (atime time.Time, ctime time.Time) {
+	atime = time.Unix(st.Atim.Unix())
+	ctime = time.Unix(st.Ctim.Unix())
+	return
+}
+
+// Convert a host device number to the encoding the kernel uses for FUSE,
+// which keeps the low byte of the minor number in the low byte.
+func kernelRdev(rdev uint64) uint32 {
+	major, minor := unix.Major(rdev), unix.Minor(rdev)
+	return minor&0xff | major<<8 | (minor&^0xff)<<12
+}
@@ -0,0 +1,477 @@
+package filesystem
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/jacobsa/fuse/fuseops"
+	"github.com/jacobsa/fuse/fuseutil"
+)
+
+// A snapshot file starts with snapshotMagic, followed by the format version as
+// a big-endian uint32, followed by a gob stream of records: a snapshotHeader,
+// then for each inode a snapshotInode followed by its snapshotRun records.
+// Each record is encoded on its own, so that neither saving nor loading ever
+// holds more than one record in encoded form.
+const (
+	snapshotMagic   = "memfs snapshot\n"
+	snapshotVersion = 1
+)
+
+// The most pages stored in a single snapshotRun.
+const snapshotRunPages = 256
+
+// The first record of a snapshot.
+type snapshotHeader struct {
+	// The number of snapshotInode records that follow.
+	Inodes int
+
+	// The generation of the journal that continues from this snapshot, if the
+	// snapshot is a journal checkpoint.
+	JournalGeneration uint64
+}
+
+// An inode. Every live inode is recorded, including unlinked ones still open
+// or known to the kernel, since the journal following a checkpoint may still
+// change and free them. Kernel state such as lookup counts is not recorded,
+// so loading frees such inodes again once nothing else needs them.
+type snapshotInode struct {
+	ID    fuseops.InodeID
+	Attrs fuseops.InodeAttributes
+
+	// For directories, the children in directory order.
+	Children []snapshotDirent
+
+	// For symlinks, the target.
+	Target string
+
+	Xattrs map[string][]byte
+
+	// For files, the number of snapshotRun records that follow.
+	Runs int
+}
+
+// Consecutive allocated pages of a file, starting at page Index. Runs of a file
+// are recorded in increasing order of index.
+//
+// INVARIANT: len(Data) is a non-zero multiple of pageSize
+type snapshotRun struct {
+	Index int64
+	Data  []byte
+}
+
+type snapshotDirent struct {
+	Name  string
+	Inode fuseops.InodeID
+	Type  fuseutil.DirentType
+}
+
+////////////////////////////////////////////////////////////////////////
+// Saving
+////////////////////////////////////////////////////////////////////////
+
+// SaveSnapshot writes the contents of the file system to the file at the given
+// path. The file is replaced atomically, so an existing snapshot survives a
+// failed save. It must be called only while the file system is not being
+// served, so that the snapshot is consistent.
+func (s *Server) SaveSnapshot(path string) (err error) {
+	err = s.fs.saveSnapshot(path)
+	return
+}
+
+func (fs *fileSystem) saveSnapshot(path string) (err error) {
+	// Write to a temporary file in the same directory, then rename it over the
+	// destination.
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		err = fmt.Errorf("TempFile: %v", err)
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	err = fs.writeSnapshot(w)
+	if err != nil {
+		return
+	}
+
+	err = w.Flush()
+	if err != nil {
+		err = fmt.Errorf("Flush: %v", err)
+		return
+	}
+
+	err = f.Sync()
+	if err != nil {
+		err = fmt.Errorf("Sync: %v", err)
+		return
+	}
+
+	err = f.Close()
+	if err != nil {
+		err = fmt.Errorf("Close: %v", err)
+		return
+	}
+
+	err = os.Rename(f.Name(), path)
+	if err != nil {
+		err = fmt.Errorf("Rename: %v", err)
+		return
+	}
+
+	// Make the rename itself durable. A journal checkpoint truncates the old
+	// journal next, which must not reach the disk before the new checkpoint.
+	err = syncDir(filepath.Dir(path))
+	if err != nil {
+		err = fmt.Errorf("Syncing directory: %v", err)
+		return
+	}
+
+	return
+}
+
+// Flush the directory at the given path to disk, including any renames into
+// it.
+func syncDir(path string) (err error) {
+	d, err := os.Open(path)
+	if err != nil {
+		return
+	}
+
+	err = d.Sync()
+	if closeErr := d.Close(); err == nil {
+		err = closeErr
+	}
+
+	return
+}
+
+func (fs *fileSystem) writeSnapshot(w io.Writer) (err error) {
+	// Skip free IDs.
+	header := snapshotHeader{
+		JournalGeneration: fs.journalGeneration,
+	}
+
+	for _, in := range fs.inodes {
+		if in != nil {
+			header.Inodes++
+		}
+	}
+
+	_, err = io.WriteString(w, snapshotMagic)
+	if err != nil {
+		err = fmt.Errorf("Writing header: %v", err)
+		return
+	}
+
+	err = binary.Write(w, binary.BigEndian, uint32(snapshotVersion))
+	if err != nil {
+		err = fmt.Errorf("Writing version: %v", err)
+		return
+	}
+
+	enc := gob.NewEncoder(w)
+	err = enc.Encode(&header)
+	if err != nil {
+		err = fmt.Errorf("Encode: %v", err)
+		return
+	}
+
+	var buf []byte
+	for i, in := range fs.inodes {
+		if in == nil {
+			continue
+		}
+
+		runs := pageRuns(in.contents.pageIndices())
+		si := snapshotInode{
+			ID:     fuseops.InodeID(i),
+			Attrs:  in.attrs,
+			Target: in.target,
+			Xattrs: in.xattrs,
+			Runs:   len(runs),
+		}
+
+		for _, e := range in.entries {
+			if e.Type == fuseutil.DT_Unknown {
+				continue
+			}
+
+			si.Children = append(si.Children, snapshotDirent{
+				Name:  e.Name,
+				Inode: e.Inode,
+				Type:  e.Type,
+			})
+		}
+
+		err = enc.Encode(&si)
+		if err != nil {
+			err = fmt.Errorf("Encode inode %v: %v", si.ID, err)
+			return
+		}
+
+		for _, run := range runs {
+			buf = buf[:0]
+			for _, index := range run {
+				buf = append(buf, in.contents.pages[index]...)
+			}
+
+			err = enc.Encode(&snapshotRun{Index: run[0], Data: buf})
+			if err != nil {
+				err = fmt.Errorf("Encode inode %v: %v", si.ID, err)
+				return
+			}
+		}
+	}
+
+	return
+}
+
+// Split the given increasing page indices into runs of consecutive indices,
+// each at most snapshotRunPages long.
+func pageRuns(indices []int64) (runs [][]int64) {
+	for len(indices) != 0 {
+		n := 1
+		for n < len(indices) && n < snapshotRunPages && indices[n] == indices[n-1]+1 {
+			n++
+		}
+
+		runs = append(runs, indices[:n])
+		indices = indices[n:]
+	}
+
+	return
+}
+
+////////////////////////////////////////////////////////////////////////
+// Loading
+////////////////////////////////////////////////////////////////////////
+
+// Replace the contents of the file system with the snapshot in the file at the
+// given path. It must be called only while the file system is not being
+// served.
+func (fs *fileSystem) loadSnapshot(path string) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	err = fs.readSnapshot(bufio.NewReader(f))
+	if err != nil {
+		err = fmt.Errorf("Reading snapshot %s: %v", path, err)
+		return
+	}
+
+	return
+}
+
+func (fs *fileSystem) readSnapshot(r io.Reader) (err error) {
+	// Check the header.
+	magic := make([]byte, len(snapshotMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil || string(magic) != snapshotMagic {
+		err = fmt.Errorf("Not a memfs snapshot")
+		return
+	}
+
+	var version uint32
+	err = binary.Read(r, binary.BigEndian, &version)
+	if err != nil {
+		err = fmt.Errorf("Reading version: %v", err)
+		return
+	}
+
+	if version != snapshotVersion {
+		err = fmt.Errorf("Unsupported snapshot version: %d", version)
+		return
+	}
+
+	dec := gob.NewDecoder(r)
+	decode := func(v interface{}) (err error) {
+		err = dec.Decode(v)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err != nil {
+			err = fmt.Errorf("Decode: %v", err)
+		}
+
+		return
+	}
+
+	var header snapshotHeader
+	err = decode(&header)
+	if err != nil {
+		return
+	}
+
+	if fs.inodeLimit != 0 && uint64(header.Inodes) > fs.inodeLimit {
+		err = fmt.Errorf(
+			"Snapshot holds %d inodes, more than the inode limit of %d",
+			header.Inodes,
+			fs.inodeLimit)
+		return
+	}
+
+	// Rebuild the inode table, keeping the directory entries aside until every
+	// inode exists.
+	inodes := make([]*inode, fuseops.RootInodeID+1)
+	children := make(map[fuseops.InodeID][]snapshotDirent)
+	var usedBytes uint64
+	for n := 0; n < header.Inodes; n++ {
+		var si snapshotInode
+		err = decode(&si)
+		if err != nil {
+			return
+		}
+
+		if si.ID < fuseops.RootInodeID {
+			err = fmt.Errorf("Illegal inode ID: %v", si.ID)
+			return
+		}
+
+		for fuseops.InodeID(len(inodes)) <= si.ID {
+			inodes = append(inodes, nil)
+		}
+
+		if inodes[si.ID] != nil {
+			err = fmt.Errorf("Duplicate inode ID: %v", si.ID)
+			return
+		}
+
+		in := newInode(si.Attrs)
+		in.attrs = si.Attrs
+		in.target = si.Target
+		if si.Xattrs != nil {
+			in.xattrs = si.Xattrs
+		}
+
+		if si.Runs != 0 && !in.isFile() {
+			err = fmt.Errorf("Contents for non-file inode: %v", si.ID)
+			return
+		}
+
+		next := int64(0)
+		for j := 0; j < si.Runs; j++ {
+			var run snapshotRun
+			err = decode(&run)
+			if err != nil {
+				return
+			}
+
+			if len(run.Data) == 0 || len(run.Data)%pageSize != 0 || run.Index < next {
+				err = fmt.Errorf("Malformed page run %d in inode %v", run.Index, si.ID)
+				return
+			}
+
+			in.contents.writeAt(run.Data, run.Index*pageSize)
+			next = run.Index + int64(len(run.Data)/pageSize)
+		}
+
+		// Make sure the snapshot fits within the size limit before reading
+		// any more of it.
+		usedBytes += in.contents.allocated()
+		if fs.sizeLimit != 0 && usedBytes > fs.sizeLimit {
+			err = fmt.Errorf(
+				"Snapshot holds more than the size limit of %d bytes",
+				fs.sizeLimit)
+			return
+		}
+
+		inodes[si.ID] = in
+		children[si.ID] = si.Children
+	}
+
+	// Link up directory entries now that every inode exists.
+	for id, in := range inodes {
+		if in == nil {
+			continue
+		}
+
+		if len(children[fuseops.InodeID(id)]) != 0 && !in.isDir() {
+			err = fmt.Errorf("Children for non-directory inode: %v", id)
+			return
+		}
+
+		for _, c := range children[fuseops.InodeID(id)] {
+			if int(c.Inode) >= len(inodes) || inodes[c.Inode] == nil {
+				err = fmt.Errorf("Dangling entry %q in inode %v", c.Name, id)
+				return
+			}
+
+			if _, _, exists := in.LookUpChild(c.Name); exists {
+				err = fmt.Errorf("Duplicate entry %q in inode %v", c.Name, id)
+				return
+			}
+
+			attrs := in.attrs
+			in.AddChild(c.Inode, c.Name, c.Type)
+			in.attrs = attrs
+
+			if c.Type == fuseutil.DT_Directory {
+				inodes[c.Inode].setParentID(fuseops.InodeID(id))
+			}
+		}
+
+		// Link counts of directories follow from the tree, except that a
+		// removed directory has none.
+		if in.isDir() && in.attrs.Nlink != 0 {
+			in.attrs.Nlink = 2 + in.subdirs()
+		}
+
+		err = checkInodeInvariants(in)
+		if err != nil {
+			err = fmt.Errorf("Inode %v: %v", id, err)
+			return
+		}
+	}
+
+	if inodes[fuseops.RootInodeID] == nil || !inodes[fuseops.RootInodeID].isDir() {
+		err = fmt.Errorf("Missing root directory")
+		return
+	}
+
+	// Install the new state.
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	fs.inodes = inodes
+	fs.usedBytes = usedBytes
+	fs.journalGeneration = header.JournalGeneration
+	fs.freeInodes = nil
+	for i := fuseops.RootInodeID + 1; i < len(inodes); i++ {
+		if inodes[i] == nil {
+			fs.freeInodes = append(fs.freeInodes, fuseops.InodeID(i))
+		}
+	}
+
+	fs.updateCounts()
+
+	return
+}
+
+// Run in.CheckInvariants, turning a violation into an error.
+func checkInodeInvariants(in *inode) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+
+	in.CheckInvariants()
+	return
+}
@@ -2,44 +2,107 @@
 // flags.
 package mount
 
-import "strings"
+import (
+	"sort"
+	"strings"
+)
 
 // ParseOptions an option string in the format accepted by mount(8) and
 // generated for its external mount helpers.
 //
-// It is assumed that option name and values do not contain commas, and that
-// the first equals sign in an option is the name/value separator. There is no
-// support for escaping.
+// Options are separated by commas, and the first equals sign in an option is
+// the name/value separator. A backslash escapes the character following it,
+// so that names and values may contain commas, equals signs and backslashes.
+// A trailing backslash stands for itself. Empty options are ignored.
 //
 // For example, if the input is
 //
-//     user,foo=bar=baz,qux
+//     user,foo=bar=baz,qux,path=a\,b
 //
 // then the following will be inserted into the map.
 //
 //     "user": "",
 //     "foo": "bar=baz",
 //     "qux": "",
+//     "path": "a,b",
 //
 func ParseOptions(m map[string]string, s string) {
 	// NOTE(jacobsa): The man pages don't define how escaping works, and as far
 	// as I can tell there is no way to properly escape or quote a comma in the
-	// options list for an fstab entry. So put our fingers in our ears and hope
-	// that nobody needs a comma.
-	for _, p := range strings.Split(s, ",") {
-		var name string
-		var value string
-
-		// Split on the first equals sign.
-		if equalsIndex := strings.IndexByte(p, '='); equalsIndex != -1 {
-			name = p[:equalsIndex]
-			value = p[equalsIndex+1:]
-		} else {
-			name = p
+	// options list for an fstab entry. Backslashes are what mount(8) itself
+	// passes through untouched, so that is what we use.
+	var name, value strings.Builder
+	cur := &name
+	sawEquals := false
+
+	flush := func() {
+		if name.Len() != 0 || sawEquals {
+			m[name.String()] = value.String()
 		}
 
-		m[name] = value
+		name.Reset()
+		value.Reset()
+		cur = &name
+		sawEquals = false
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\\' && i+1 < len(s):
+			i++
+			cur.WriteByte(s[i])
+
+		case c == ',':
+			flush()
+
+		case c == '=' && !sawEquals:
+			sawEquals = true
+			cur = &value
+
+		default:
+			cur.WriteByte(c)
+		}
 	}
 
+	flush()
+
 	return
 }
+
+// FormatOptions is the inverse of ParseOptions. It returns the options in the
+// map as a single option string, sorted by name, escaping commas, equals signs
+// and backslashes as necessary.
+func FormatOptions(m map[string]string) string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		p := escapeOption(name, `\,=`)
+		if value := m[name]; value != "" {
+			p += "=" + escapeOption(value, `\,`)
+		}
+
+		parts = append(parts, p)
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// Escape the given special characters in s with backslashes.
+func escapeOption(s string, special string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if strings.IndexByte(special, s[i]) != -1 {
+			b.WriteByte('\\')
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
@@ -0,0 +1,61 @@
+package mount
+
+import (
+	"testing"
+
+	. "gopkg.in/check.v1"
+)
+
+func Test(t *testing.T) { TestingT(t) }
+
+type FlagSuite struct{}
+
+var _ = Suite(&FlagSuite{})
+
+func (s *FlagSuite) TestParseOptions(c *C) {
+	m := make(map[string]string)
+	ParseOptions(m, "user,foo=bar=baz,qux")
+
+	c.Assert(m, DeepEquals, map[string]string{
+		"user": "",
+		"foo":  "bar=baz",
+		"qux":  "",
+	})
+}
+
+func (s *FlagSuite) TestParseOptionsEscaping(c *C) {
+	m := make(map[string]string)
+	ParseOptions(m, `path=a\,b,a\=b=c,back=\\,,trailing=\`)
+
+	c.Assert(m, DeepEquals, map[string]string{
+		"path":     "a,b",
+		"a=b":      "c",
+		"back":     `\`,
+		"trailing": `\`,
+	})
+}
+
+func (s *FlagSuite) TestParseOptionsRepeated(c *C) {
+	m := make(map[string]string)
+	ParseOptions(m, "a=1")
+	ParseOptions(m, "a=2,b")
+
+	c.Assert(m, DeepEquals, map[string]string{"a": "2", "b": ""})
+}
+
+func (s *FlagSuite) TestFormatOptions(c *C) {
+	in := map[string]string{
+		"user":  "",
+		"foo":   "bar=baz",
+		"path":  `a,b\c`,
+		"a=b":   "c",
+		"empty": "",
+	}
+
+	formatted := FormatOptions(in)
+	c.Assert(formatted, Equals, `a\=b=c,empty,foo=bar=baz,path=a\,b\\c,user`)
+
+	out := make(map[string]string)
+	ParseOptions(out, formatted)
+	c.Assert(out, DeepEquals, in)
+}
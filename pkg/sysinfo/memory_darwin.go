@@ -0,0 +1,9 @@
+package sysinfo
+
+import "golang.org/x/sys/unix"
+
+// TotalMemory returns the amount of physical memory in the system, in bytes.
+func TotalMemory() (bytes uint64, err error) {
+	bytes, err = unix.SysctlUint64("hw.memsize")
+	return
+}
@@ -0,0 +1,15 @@
+package sysinfo
+
+import "golang.org/x/sys/unix"
+
+// TotalMemory returns the amount of physical memory in the system, in bytes.
+func TotalMemory() (bytes uint64, err error) {
+	var info unix.Sysinfo_t
+	err = unix.Sysinfo(&info)
+	if err != nil {
+		return
+	}
+
+	bytes = uint64(info.Totalram) * uint64(info.Unit)
+	return
+}